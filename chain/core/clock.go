@@ -0,0 +1,57 @@
+package core
+
+import (
+	"time"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// SimulatedGenesisTime is the timestamp of the genesis block when the chain runs
+// with a simulated clock.
+var SimulatedGenesisTime = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock provides timestamps for new blocks
+type Clock interface {
+	// Next returns the timestamp of a block built on top of the parent,
+	// which is nil for the genesis block.
+	Next(parent *types.Block) time.Time
+}
+
+// NewSystemClock returns a clock that stamps blocks with the current time, or
+// right after their parent when it is in the future
+func NewSystemClock() Clock {
+	return systemClock{}
+}
+
+// NewSimulatedClock returns a clock that spaces blocks exactly one block time
+// apart, so timestamps only depend on the chain itself and not on when it runs.
+func NewSimulatedClock(genesisTime time.Time, blockTime time.Duration) Clock {
+	return simulatedClock{
+		genesisTime: genesisTime.UTC(),
+		blockTime:   blockTime,
+	}
+}
+
+type systemClock struct{}
+
+// Next never goes back before the parent, which is ahead of the current time when
+// it was generated with a simulated clock
+func (systemClock) Next(parent *types.Block) time.Time {
+	now := time.Now().UTC()
+	if parent != nil && !now.After(parent.Timestamp) {
+		return parent.Timestamp.UTC().Add(time.Nanosecond)
+	}
+	return now
+}
+
+type simulatedClock struct {
+	genesisTime time.Time
+	blockTime   time.Duration
+}
+
+func (c simulatedClock) Next(parent *types.Block) time.Time {
+	if parent == nil {
+		return c.genesisTime
+	}
+	return parent.Timestamp.UTC().Add(c.blockTime)
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/deepmind"
+)
+
+const (
+	// The node stops with an error at the first failure
+	EmitPolicyHalt = "halt"
+
+	// The block is emitted again with backoff, the node stops once all retries fail
+	EmitPolicyRetry = "retry"
+
+	// Block production is paused and the block is emitted again with backoff until
+	// the DeepMind output recovers
+	EmitPolicyPause = "pause"
+)
+
+const (
+	emitMinBackoff = 100 * time.Millisecond
+	emitMaxBackoff = 10 * time.Second
+)
+
+// EmitConfig defines what the node does when a block can't be written to the
+// DeepMind output. The node never produces the next block before the current one
+// is fully emitted, whatever the policy.
+type EmitConfig struct {
+	Policy string
+
+	// Number of retries of the retry policy
+	Retries int
+}
+
+func (c EmitConfig) Validate() error {
+	switch c.Policy {
+	case EmitPolicyHalt, EmitPolicyPause:
+	case EmitPolicyRetry:
+		if c.Retries < 1 {
+			return errors.New("emit retries must be greater than 0")
+		}
+	default:
+		return fmt.Errorf("unsupported emit policy: %q", c.Policy)
+	}
+	return nil
+}
+
+// emitWithPolicy calls emit until it succeeds or the policy gives up. The output
+// of the failed attempt is aborted first, and a block emitted again starts over
+// from its BLOCK_BEGIN line.
+func (node *Node) emitWithPolicy(ctx context.Context, height uint64, emit func() error) error {
+	delay := emitMinBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := emit()
+		if err == nil {
+			if attempt > 1 {
+				logrus.WithField("height", height).WithField("attempts", attempt).Info("deepmind output recovered")
+			}
+			return nil
+		}
+
+		policy := node.emitConfig.Policy
+		if policy == EmitPolicyHalt || (policy == EmitPolicyRetry && attempt > node.emitConfig.Retries) {
+			return fmt.Errorf("cant emit block %d: %w", height, err)
+		}
+
+		logrus.
+			WithField("height", height).
+			WithField("attempt", attempt).
+			WithField("delay", delay).
+			WithField("policy", policy).
+			WithError(err).
+			Warn("cant emit block, production is paused until it is emitted")
+
+		if err := deepmind.AbortBlock(); err != nil {
+			logrus.WithField("height", height).WithError(err).Warn("cant abort partially emitted block")
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if delay *= 2; delay > emitMaxBackoff {
+			delay = emitMaxBackoff
+		}
+	}
+}
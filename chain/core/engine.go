@@ -4,93 +4,523 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"sync"
 	"time"
 
 	"github.com/figment-networks/graph-instrumentation-example/chain/types"
 	"github.com/sirupsen/logrus"
 )
 
+// Number of recent block states kept in memory by the engine
+const stateHistorySize = 16
+
+// Timestamp offset of the first competing block, so both branches of a fork
+// never produce identical blocks.
+const forkDelay = time.Millisecond
+
+var syntheticAccounts = []string{"0xDEADBEEF", "0xBAAAAAAD"}
+
 type Engine struct {
 	genesisHeight uint64
+	genesisHash   string
+	allocations   map[string]*big.Int
 	blockRate     time.Duration
 	blockChan     chan *types.Block
+	ackChan       chan struct{}
 	prevBlock     *types.Block
+	state         *State
+	producerKey   *ProducerKey
+	forkConfig    ForkConfig
+	fork          *fork
+	forkCount     uint64
+
+	// Hash of the first block abandoned by a rollback, which must not be recreated
+	abandoned string
+
+	// Deterministic mode is enabled with a non-zero seed. Random values are
+	// derived from randSeed and the block height, see chainRand.
+	seed     int64
+	clock    Clock
+	randSeed int64
+
+	finalityConfig FinalityConfig
+	finality       finalityTracker
+	lib            uint64
+
+	mempool *Mempool
+
+	statesLock   sync.RWMutex
+	states       map[string]*State
+	statesHashes []string
+	statesLimit  int
+	head         string
 }
 
-func NewEngine(genesisHeight uint64, rate int) Engine {
-	blockRate := time.Second / time.Duration(rate)
+func NewEngine(genesisHeight uint64, blockRate time.Duration, forkConfig ForkConfig, finalityConfig FinalityConfig, mempool *Mempool, seed int64) Engine {
+	// With a seed, blocks only depend on the chain config and not on the time they
+	// were produced at, so every run creates the exact same chain.
+	clock := NewSystemClock()
+	randSeed := time.Now().UnixNano()
+	if seed != 0 {
+		clock = NewSimulatedClock(SimulatedGenesisTime, blockRate)
+		randSeed = seed
+	}
 
 	if genesisHeight == 0 {
 		genesisHeight = 1
 	}
 
+	// Both branches of a fork must stay in the history until the reorg happens
+	statesLimit := stateHistorySize
+	if limit := int(2*forkConfig.Depth) + 2; limit > statesLimit {
+		statesLimit = limit
+	}
+
 	return Engine{
-		genesisHeight: genesisHeight,
-		blockRate:     blockRate,
-		blockChan:     make(chan *types.Block),
+		genesisHeight:  genesisHeight,
+		allocations:    GenesisAllocations,
+		blockRate:      blockRate,
+		blockChan:      make(chan *types.Block),
+		ackChan:        make(chan struct{}, 1),
+		forkConfig:     forkConfig,
+		seed:           seed,
+		clock:          clock,
+		randSeed:       randSeed,
+		finalityConfig: finalityConfig,
+		mempool:        mempool,
+		states:         map[string]*State{},
+		statesLimit:    statesLimit,
 	}
 }
 
-func (e *Engine) Initialize(block *types.Block) error {
+func (e *Engine) Initialize(block *types.Block, state *State, producerKey *ProducerKey) error {
+	if err := e.forkConfig.Validate(); err != nil {
+		return err
+	}
+
+	if err := e.finalityConfig.Validate(); err != nil {
+		return err
+	}
+
+	if state == nil {
+		state = NewGenesisState(e.allocations)
+	}
+
 	e.prevBlock = block
+	e.state = state
+	e.producerKey = producerKey
+
+	// Genesis state is kept under an empty hash until the first block is produced
+	head := ""
+	if block != nil {
+		e.lib = block.LibNum
+		head = block.Hash
+	}
+
+	e.commitState(head, state)
+	e.setHead(head)
+
+	e.finality = newFinalityTracker(e.finalityConfig, e.lib, e.randSeed)
+
 	return nil
 }
 
-func (e *Engine) StartBlockProduction(ctx context.Context) {
+// StartBlockProduction produces blocks at the block rate until the context is
+// done or a block can't be created, the subscription is closed in both cases
+func (e *Engine) StartBlockProduction(ctx context.Context) error {
 	logrus.WithField("rate", e.blockRate).Info("starting block producer")
 
+	logrus.
+		WithField("mode", e.finalityConfig.Mode).
+		WithField("depth", e.finalityConfig.Depth).
+		WithField("lib", e.lib).
+		Info("tracking last irreversible block")
+
+	if e.seed != 0 {
+		logrus.WithField("seed", e.seed).Info("deterministic mode is enabled")
+	}
+
+	if e.forkConfig.Enabled() {
+		logrus.
+			WithField("interval", e.forkConfig.Interval).
+			WithField("depth", e.forkConfig.Depth).
+			Info("fork simulation is enabled")
+	}
+
+	defer close(e.blockChan)
+
 	for {
 		select {
 		case <-time.Tick(e.blockRate):
-			block := e.createBlock()
-			e.blockChan <- &block
+			blocks, err := e.produceBlocks()
+			if err != nil {
+				logrus.WithError(err).Error("stopping block producer")
+				return err
+			}
+
+			for _, block := range blocks {
+				if !e.deliverBlock(ctx, block) {
+					logrus.Info("stopping block producer")
+					return nil
+				}
+			}
 		case <-ctx.Done():
 			logrus.Info("stopping block producer")
-			close(e.blockChan)
-			return
+			return nil
 		}
 	}
 }
 
+// deliverBlock sends the block to the subscription and waits until the receiver
+// acknowledges it with Ack. Production stays paused in the meantime, so a node
+// that can't emit a block doesn't take more transactions from the mempool.
+func (e *Engine) deliverBlock(ctx context.Context, block *types.Block) bool {
+	select {
+	case e.blockChan <- block:
+	case <-ctx.Done():
+		return false
+	}
+
+	select {
+	case <-e.ackChan:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Ack tells the engine the last block received from the subscription is handled,
+// the engine produces the next block only then
+func (e *Engine) Ack() {
+	select {
+	case e.ackChan <- struct{}{}:
+	default:
+	}
+}
+
+// UseGenesis starts the chain from the genesis height, balances and time
+func (e *Engine) UseGenesis(genesis *Genesis) {
+	e.genesisHeight = genesis.GenesisHeight
+	e.genesisHash = genesis.Hash()
+	e.allocations = genesis.Allocations
+
+	if e.seed != 0 {
+		e.clock = NewSimulatedClock(genesis.GenesisTime, e.blockRate)
+	}
+}
+
+// UseClock replaces the clock used for timestamps of new blocks
+func (e *Engine) UseClock(clock Clock) {
+	e.clock = clock
+}
+
 func (e *Engine) Subscription() <-chan *types.Block {
 	return e.blockChan
 }
 
-func (e *Engine) createBlock() types.Block {
-	block := types.Block{
-		Timestamp:    time.Now().UTC(),
+// State returns the account state after the execution of the block with given hash
+func (e *Engine) State(hash string) *State {
+	e.statesLock.RLock()
+	defer e.statesLock.RUnlock()
+
+	return e.states[hash]
+}
+
+// HeadState returns the account state at the head of the canonical chain
+func (e *Engine) HeadState() *State {
+	e.statesLock.RLock()
+	defer e.statesLock.RUnlock()
+
+	return e.states[e.head]
+}
+
+// produceBlocks returns all blocks created during a single production round.
+// Outside of a fork that's a single block extending the chain. During a fork
+// the competing branch gets a sibling block at the same height, until it's
+// extended past the canonical branch and becomes the new canonical chain.
+func (e *Engine) produceBlocks() ([]*types.Block, error) {
+	if e.fork != nil {
+		if e.fork.length == e.forkConfig.Depth {
+			block, err := e.switchToFork()
+			if err != nil {
+				return nil, err
+			}
+			return []*types.Block{block}, nil
+		}
+
+		return e.createForkRound()
+	}
+
+	if !e.shouldFork() {
+		block, err := e.createBlock()
+		if err != nil {
+			return nil, err
+		}
+		return []*types.Block{block}, nil
+	}
+
+	e.forkCount++
+	e.fork = &fork{
+		id:    e.forkCount,
+		base:  e.prevBlock.Height,
+		tip:   e.prevBlock,
+		state: e.state,
+	}
+
+	logrus.
+		WithField("height", e.prevBlock.Height+1).
+		WithField("fork", e.fork.id).
+		Info("starting competing branch")
+
+	return e.createForkRound()
+}
+
+// createForkRound extends both the canonical chain and the competing branch
+func (e *Engine) createForkRound() ([]*types.Block, error) {
+	block, err := e.createBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	forkBlock, err := e.extendFork()
+	if err != nil {
+		return nil, err
+	}
+
+	return []*types.Block{block, forkBlock}, nil
+}
+
+func (e *Engine) shouldFork() bool {
+	if !e.forkConfig.Enabled() || e.prevBlock == nil {
+		return false
+	}
+
+	height := e.prevBlock.Height + 1
+	if height < e.genesisHeight+e.forkConfig.Depth {
+		return false
+	}
+
+	return height%e.forkConfig.Interval == 0
+}
+
+// extendFork adds a new block on top of the competing branch
+func (e *Engine) extendFork() (*types.Block, error) {
+	timestamp := e.clock.Next(e.fork.tip)
+	if e.fork.length == 0 {
+		timestamp = timestamp.Add(forkDelay)
+	}
+
+	block, state, err := e.newBlock(e.fork.tip, e.fork.state, nil, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	e.fork.tip = block
+	e.fork.state = state
+	e.fork.length++
+	e.commitState(block.Hash, state)
+
+	return block, nil
+}
+
+// switchToFork makes the competing branch longer than the canonical one, so
+// it becomes the canonical chain and the previous blocks are abandoned.
+func (e *Engine) switchToFork() (*types.Block, error) {
+	abandoned := e.prevBlock
+	block, err := e.extendFork()
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.
+		WithField("height", block.Height).
+		WithField("fork", e.fork.id).
+		WithField("depth", e.fork.length-1).
+		WithField("abandoned_tip", abandoned.Hash).
+		Info("switching to competing branch")
+
+	// Transactions from abandoned blocks are not lost, they go back to the pool
+	if len(e.fork.pooled) > 0 {
+		logrus.WithField("count", len(e.fork.pooled)).Info("returning abandoned transactions to mempool")
+		e.mempool.Readd(e.fork.pooled)
+	}
+
+	e.prevBlock = block
+	e.state = e.fork.state
+	e.fork = nil
+	e.setHead(block.Hash)
+
+	return block, nil
+}
+
+// createBlock extends the canonical chain with a new block
+func (e *Engine) createBlock() (*types.Block, error) {
+	pooled := e.mempool.Drain(e.state)
+
+	block, state, err := e.newBlock(e.prevBlock, e.state, pooled, e.clock.Next(e.prevBlock))
+	if err != nil {
+		// The transactions were not included, they go back to the pool
+		e.mempool.Readd(pooled)
+		return nil, err
+	}
+
+	if e.fork != nil {
+		e.fork.pooled = append(e.fork.pooled, pooled...)
+	}
+
+	e.prevBlock = block
+	e.state = state
+	e.commitState(block.Hash, state)
+	e.setHead(block.Hash)
+
+	return block, nil
+}
+
+// newBlock builds a block on top of the parent, with given pool transactions
+// followed by the synthetic ones.
+func (e *Engine) newBlock(parent *types.Block, parentState *State, pooled []types.Transaction, timestamp time.Time) (*types.Block, *State, error) {
+	block := &types.Block{
+		Timestamp:    timestamp,
+		Producer:     e.producerKey.Address,
 		Transactions: []types.Transaction{},
 	}
 
-	if e.prevBlock != nil { // Continue the chain
-		block.Height = e.prevBlock.Height + 1
-		block.Hash = makeHash(block.Height)
-		block.PrevHash = e.prevBlock.Hash
+	if parent != nil { // Continue the chain
+		block.Height = parent.Height + 1
+		block.PrevHash = parent.Hash
 	} else { // Start from genesis height
 		logrus.WithField("height", e.genesisHeight).Info("starting from genesis block height")
 
 		block.Height = e.genesisHeight
-		block.Hash = makeHash(e.genesisHeight)
-		block.PrevHash = makeHash(e.genesisHeight)
+		block.PrevHash = e.genesisHash
+		if block.PrevHash == "" {
+			block.PrevHash = makeHash(e.genesisHeight)
+		}
 	}
 
-	for i := uint64(0); i < block.Height%10; i++ {
+	block.LibNum = e.nextLib(block.Height)
+
+	state := parentState.Clone()
+	state.Height = block.Height
+
+	for _, tx := range pooled {
+		changes, err := state.TraceTransaction(&tx)
+		if err != nil {
+			logrus.
+				WithField("tx", tx.Hash).
+				WithField("sender", tx.Sender).
+				WithError(err).
+				Debug("transaction failed")
+		}
+
+		block.Transactions = append(block.Transactions, tx)
+		state.BalanceChanges = append(state.BalanceChanges, changes)
+	}
+
+	// Seeded chains get a random number of transfers with random amounts,
+	// otherwise the pattern repeats every 10 blocks.
+	rand := newChainRand(e.randSeed, block.Height)
+
+	count := block.Height % 10
+	if e.seed != 0 {
+		count = uint64(rand.Intn(10))
+	}
+
+	for i := uint64(0); i < count; i++ {
+		sender := syntheticAccounts[i%2]
+		receiver := syntheticAccounts[(i+1)%2]
+
+		amount := int64(i * 1000000000)
+		if e.seed != 0 {
+			amount = rand.Int63n(10000000000)
+		}
+
 		tx := types.Transaction{
 			Type:     "transfer",
-			Hash:     makeHash(fmt.Sprintf("%v-%v", block.Height, i)),
-			Sender:   "0xDEADBEEF",
-			Receiver: "0xBAAAAAAD",
-			Amount:   big.NewInt(int64(i * 1000000000)),
+			Sender:   sender,
+			Receiver: receiver,
+			Amount:   big.NewInt(amount),
 			Fee:      big.NewInt(10000),
-			Success:  true,
+			Nonce:    state.Nonce(sender),
 			Events:   e.generateEvents(block.Height),
 		}
+		tx.Hash = HashTransaction(&tx)
+
+		changes, err := state.TraceTransaction(&tx)
+		if err != nil {
+			logrus.
+				WithField("tx", tx.Hash).
+				WithField("sender", tx.Sender).
+				WithError(err).
+				Debug("transaction failed")
+		}
 
 		block.Transactions = append(block.Transactions, tx)
+		state.BalanceChanges = append(state.BalanceChanges, changes)
+	}
+
+	txRoot, err := TxRoot(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cant compute transactions root of block %d: %w", block.Height, err)
+	}
+
+	block.TxRoot = txRoot
+	block.Hash = HashBlock(block)
+
+	// Replaying the rolled back chain could reproduce the exact same block, which
+	// would make the rollback invisible to the consumers of the chain.
+	if block.Hash == e.abandoned {
+		block.Timestamp = block.Timestamp.Add(forkDelay)
+		block.Hash = HashBlock(block)
+	}
+	state.Hash = block.Hash
+
+	if err := SignBlock(block, e.producerKey); err != nil {
+		return nil, nil, fmt.Errorf("cant sign block %d: %w", block.Height, err)
 	}
 
-	e.prevBlock = &block
-	return block
+	return block, state, nil
+}
+
+// nextLib advances the last irreversible block for a new block at given height.
+// While a fork is in progress the LIB can't move past the fork base.
+func (e *Engine) nextLib(height uint64) uint64 {
+	lib := e.finality.next(height)
+
+	if e.fork != nil && lib > e.fork.base {
+		lib = e.fork.base
+	}
+
+	if lib < e.lib {
+		lib = e.lib
+	}
+
+	e.lib = lib
+	return lib
+}
+
+func (e *Engine) setHead(hash string) {
+	e.statesLock.Lock()
+	defer e.statesLock.Unlock()
+
+	e.head = hash
+}
+
+func (e *Engine) commitState(hash string, state *State) {
+	e.statesLock.Lock()
+	defer e.statesLock.Unlock()
+
+	if _, ok := e.states[hash]; ok {
+		return
+	}
+
+	e.states[hash] = state
+	e.statesHashes = append(e.statesHashes, hash)
+
+	if len(e.statesHashes) > e.statesLimit {
+		delete(e.states, e.statesHashes[0])
+		e.statesHashes = e.statesHashes[1:]
+	}
 }
 
 func (e *Engine) generateEvents(height uint64) []types.Event {
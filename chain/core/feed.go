@@ -0,0 +1,63 @@
+package core
+
+import (
+	"sync"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+	"github.com/sirupsen/logrus"
+)
+
+// BlockFeed broadcasts new canonical blocks to subscribers
+type BlockFeed struct {
+	lock   sync.Mutex
+	subs   map[int]chan *types.Block
+	nextID int
+}
+
+func NewBlockFeed() *BlockFeed {
+	return &BlockFeed{
+		subs: map[int]chan *types.Block{},
+	}
+}
+
+// Subscribe returns a channel receiving new blocks and a function to cancel
+// the subscription. A subscriber that falls behind by more than the buffer
+// size is dropped and its channel is closed.
+func (f *BlockFeed) Subscribe(buffer int) (<-chan *types.Block, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	id := f.nextID
+	f.nextID++
+
+	ch := make(chan *types.Block, buffer)
+	f.subs[id] = ch
+
+	return ch, func() { f.unsubscribe(id) }
+}
+
+// Publish sends the block to all subscribers without blocking
+func (f *BlockFeed) Publish(block *types.Block) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for id, ch := range f.subs {
+		select {
+		case ch <- block:
+		default:
+			logrus.WithField("subscriber", id).Warn("dropping slow block subscriber")
+			close(ch)
+			delete(f.subs, id)
+		}
+	}
+}
+
+func (f *BlockFeed) unsubscribe(id int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if ch, ok := f.subs[id]; ok {
+		close(ch)
+		delete(f.subs, id)
+	}
+}
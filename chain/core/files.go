@@ -0,0 +1,102 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Suffix of temporary files replaced atomically
+const tmpFileSuffix = ".tmp"
+
+// writeFileAtomic replaces the file with given data, so the file either has the
+// previous or the new content even when the process crashes in the middle.
+// The data is written to a temporary file, synced and renamed over the target.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := replaceFile(path, data, perm, true); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// replaceFile writes the data to a temporary file and renames it over the target.
+// Without sync the content may not be on disk yet, see syncFile.
+func replaceFile(path string, data []byte, perm os.FileMode, sync bool) error {
+	tmpPath := path + tmpFileSuffix
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// syncFile flushes the content of a file written without sync to disk
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// syncDir makes renames and removals within the directory durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// removeTmpFiles removes temporary files left behind by interrupted writes
+func removeTmpFiles(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+tmpFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
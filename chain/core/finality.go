@@ -0,0 +1,116 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// Blocks become irreversible at a fixed depth below the head
+	FinalityModeDepth = "depth"
+
+	// Blocks become irreversible once confirmed by 2/3+ of the simulated validators
+	FinalityModeValidators = "validators"
+)
+
+// FinalityConfig controls how the last irreversible block (LIB) is computed
+type FinalityConfig struct {
+	// Finality rule, either "depth" or "validators"
+	Mode string
+
+	// Number of blocks below the head that are considered irreversible in depth mode,
+	// and the maximum confirmation lag of each validator in validators mode
+	Depth uint64
+
+	// Size of the simulated validator set in validators mode
+	Validators int
+}
+
+func (c FinalityConfig) Validate() error {
+	switch c.Mode {
+	case FinalityModeDepth:
+	case FinalityModeValidators:
+		if c.Validators < 1 {
+			return errors.New("validators count must be greater than 0")
+		}
+	default:
+		return fmt.Errorf("unsupported finality mode: %q", c.Mode)
+	}
+
+	if c.Depth == 0 {
+		return errors.New("finality depth must be greater than 0")
+	}
+
+	return nil
+}
+
+// finalityTracker computes the last irreversible block for newly produced blocks
+type finalityTracker interface {
+	// next returns the LIB height as of the block with given height
+	next(height uint64) uint64
+}
+
+func newFinalityTracker(config FinalityConfig, lib uint64, seed int64) finalityTracker {
+	if config.Mode == FinalityModeValidators {
+		return &validatorsFinality{
+			seed:       seed,
+			maxLag:     config.Depth,
+			validators: config.Validators,
+			lib:        lib,
+		}
+	}
+
+	return &depthFinality{depth: config.Depth}
+}
+
+type depthFinality struct {
+	depth uint64
+}
+
+func (f *depthFinality) next(height uint64) uint64 {
+	if height <= f.depth {
+		return 0
+	}
+	return height - f.depth
+}
+
+// validatorsFinality simulates a validator set where every validator confirms
+// blocks with a random lag behind the head. The lag of each validator at each
+// height only depends on the seed, so the LIB does not depend on restarts.
+type validatorsFinality struct {
+	seed       int64
+	maxLag     uint64
+	validators int
+
+	// LIB when the tracker was created, it never goes below
+	lib uint64
+}
+
+func (f *validatorsFinality) next(height uint64) uint64 {
+	heights := make([]uint64, f.validators)
+
+	for i := range heights {
+		heights[i] = f.lib
+
+		// A confirmation made before the last maxLag heights is always exceeded
+		// by the one made at the height itself
+		from := uint64(1)
+		if height > f.maxLag {
+			from = height - f.maxLag + 1
+		}
+
+		for h := from; h <= height; h++ {
+			lag := 1 + uint64(newChainRand(f.seed, h, uint64(i)).Int63n(int64(f.maxLag)))
+			if h > lag && h-lag > heights[i] {
+				heights[i] = h - lag
+			}
+		}
+	}
+
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	// Highest block confirmed by more than 2/3 of validators
+	quorum := len(heights)*2/3 + 1
+	return heights[quorum-1]
+}
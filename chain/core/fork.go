@@ -0,0 +1,49 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// ForkConfig controls the fork and reorg simulation of the block producer
+type ForkConfig struct {
+	// Number of blocks between the start of each fork, 0 disables forking
+	Interval uint64
+
+	// Number of canonical blocks abandoned when the competing branch takes over
+	Depth uint64
+}
+
+func (c ForkConfig) Enabled() bool {
+	return c.Interval > 0
+}
+
+func (c ForkConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.Depth == 0 {
+		return errors.New("reorg depth must be greater than 0")
+	}
+
+	if c.Interval <= c.Depth {
+		return fmt.Errorf("fork interval (%d) must be greater than reorg depth (%d)", c.Interval, c.Depth)
+	}
+
+	return nil
+}
+
+// fork tracks the competing branch while it's being built
+type fork struct {
+	id     uint64
+	base   uint64
+	tip    *types.Block
+	state  *State
+	length uint64
+
+	// Pool transactions included in the canonical blocks abandoned by this fork
+	pooled []types.Transaction
+}
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+const genesisFilename = "genesis.json"
+
+// DefaultChainID identifies chains of stores without genesis file
+const DefaultChainID = "dummychain"
+
+// Genesis defines a chain network. Stores initialized with a genesis file only
+// hold blocks of that network, the first block links to the genesis hash.
+type Genesis struct {
+	ChainID string `json:"chain_id"`
+
+	// Timestamp of the first block, the node does not produce blocks before it
+	GenesisTime time.Time `json:"genesis_time"`
+
+	// Height of the first block
+	GenesisHeight uint64 `json:"genesis_height"`
+
+	BlockTime     Duration `json:"block_time"`
+	FinalityDepth uint64   `json:"finality_depth"`
+
+	// Initial account balances
+	Allocations map[string]*big.Int `json:"allocations"`
+
+	Params GenesisParams `json:"params"`
+}
+
+type GenesisParams struct {
+	Finality GenesisFinalityParams `json:"finality"`
+	Mempool  GenesisMempoolParams  `json:"mempool"`
+}
+
+type GenesisFinalityParams struct {
+	// Finality rule, either "depth" or "validators"
+	Mode string `json:"mode"`
+
+	// Size of the simulated validator set in validators mode
+	Validators int `json:"validators"`
+}
+
+type GenesisMempoolParams struct {
+	// Maximum number of pool transactions included in a single block
+	BlockTxLimit int `json:"block_tx_limit"`
+}
+
+// Duration is a time.Duration encoded as a string like "1s" or "250ms"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// ReadGenesisFile reads and validates a genesis file. Omitted parameters get the
+// same defaults as the command line flags.
+func ReadGenesisFile(path string) (*Genesis, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	genesis := &Genesis{
+		GenesisHeight: 1,
+		BlockTime:     Duration(time.Second),
+		FinalityDepth: 1,
+		Params: GenesisParams{
+			Finality: GenesisFinalityParams{Mode: FinalityModeDepth, Validators: 4},
+			Mempool:  GenesisMempoolParams{BlockTxLimit: 100},
+		},
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(genesis); err != nil {
+		return nil, fmt.Errorf("cant decode genesis file %s: %v", path, err)
+	}
+	if err := genesis.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid genesis file %s: %v", path, err)
+	}
+
+	genesis.GenesisTime = genesis.GenesisTime.UTC()
+	if genesis.Allocations == nil {
+		genesis.Allocations = map[string]*big.Int{}
+	}
+
+	return genesis, nil
+}
+
+func (g *Genesis) Validate() error {
+	if g.ChainID == "" {
+		return errors.New("chain id is required")
+	}
+	if strings.IndexFunc(g.ChainID, unicode.IsSpace) >= 0 {
+		return errors.New("chain id must not contain whitespace")
+	}
+	if g.GenesisTime.IsZero() {
+		return errors.New("genesis time is required")
+	}
+	if g.GenesisHeight == 0 {
+		return errors.New("genesis height must be greater than 0")
+	}
+	if g.BlockTime <= 0 {
+		return errors.New("block time must be greater than 0")
+	}
+
+	for addr, balance := range g.Allocations {
+		if addr == "" {
+			return errors.New("allocation address is required")
+		}
+		if balance == nil || balance.Sign() < 0 {
+			return fmt.Errorf("allocation of %s must not be negative", addr)
+		}
+	}
+
+	if err := g.FinalityConfig().Validate(); err != nil {
+		return err
+	}
+
+	return MempoolConfig{Size: 1, BlockLimit: g.Params.Mempool.BlockTxLimit}.Validate()
+}
+
+// Hash returns the hash of the genesis content, which identifies the network
+func (g *Genesis) Hash() string {
+	// Map keys are sorted by the encoder, so equal genesis always give equal hashes
+	data, err := json.Marshal(g)
+	if err != nil {
+		panic(err)
+	}
+
+	shaSum := sha256.Sum256(data)
+	return hex.EncodeToString(shaSum[:])
+}
+
+func (g *Genesis) FinalityConfig() FinalityConfig {
+	return FinalityConfig{
+		Mode:       g.Params.Finality.Mode,
+		Depth:      g.FinalityDepth,
+		Validators: g.Params.Finality.Validators,
+	}
+}
+
+// State returns the account state before the first block
+func (g *Genesis) State() *State {
+	return NewGenesisState(g.Allocations)
+}
+
+// ReadStoreGenesis returns the genesis the store directory was initialized with,
+// or nil when the store is configured with the command line flags only.
+func ReadStoreGenesis(dir string) (*Genesis, error) {
+	path := filepath.Join(dir, genesisFilename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return ReadGenesisFile(path)
+}
+
+// InitStoreGenesis binds an empty store to the genesis. Initializing the store
+// again with the same genesis has no effect.
+func InitStoreGenesis(store Store, genesis *Genesis) error {
+	existing, err := ReadStoreGenesis(store.Dir())
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		if existing.Hash() != genesis.Hash() {
+			return fmt.Errorf("store is already initialized with genesis %s of chain %q", existing.Hash(), existing.ChainID)
+		}
+		return nil
+	}
+
+	if store.TipHeight() > 0 {
+		return errors.New("store already has blocks, a genesis can only be set on an empty store")
+	}
+
+	data, err := json.MarshalIndent(genesis, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(store.Dir(), genesisFilename), data, 0644)
+}
+
+// initialState returns the account state the stored chain starts from
+func initialState(store Store) (*State, *Genesis, error) {
+	genesis, err := ReadStoreGenesis(store.Dir())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if genesis == nil {
+		return NewGenesisState(GenesisAllocations), nil, nil
+	}
+	return genesis.State(), genesis, nil
+}
+
+// checkGenesisLink makes sure the first block of the chain belongs to the genesis
+func checkGenesisLink(genesis *Genesis, block *types.Block) error {
+	if block.Height != genesis.GenesisHeight || block.PrevHash != genesis.Hash() {
+		return fmt.Errorf("block %d does not link to genesis %s of chain %q", block.Height, genesis.Hash(), genesis.ChainID)
+	}
+	return nil
+}
@@ -2,10 +2,85 @@ package core
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
 )
 
 func makeHash(data interface{}) string {
 	shaSum := sha256.Sum256([]byte(fmt.Sprintf("%v", data)))
 	return fmt.Sprintf("%x", shaSum)
 }
+
+// HashBlock returns the block hash computed over the block header
+func HashBlock(block *types.Block) string {
+	h := sha256.New()
+
+	writeUint64(h, block.Height)
+	writeString(h, block.PrevHash)
+	writeUint64(h, uint64(block.Timestamp.UnixNano()))
+	writeString(h, block.TxRoot)
+	writeString(h, block.Producer)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashTransaction returns the transaction hash computed over its content.
+// Execution results like success flag and events are not covered.
+func HashTransaction(tx *types.Transaction) string {
+	h := sha256.New()
+
+	writeString(h, tx.Type)
+	writeString(h, tx.Sender)
+	writeString(h, tx.Receiver)
+	writeBytes(h, tx.Amount.Bytes())
+	writeBytes(h, tx.Fee.Bytes())
+	writeUint64(h, tx.Nonce)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// TxRoot returns the merkle root of all transaction hashes in the block
+func TxRoot(block *types.Block) (string, error) {
+	return MerkleRoot(txHashes(block))
+}
+
+// TxProof returns the merkle inclusion proof for the transaction with given hash
+func TxProof(block *types.Block, txHash string) (*MerkleProof, error) {
+	hashes := txHashes(block)
+
+	for idx, hash := range hashes {
+		if hash == txHash {
+			return NewMerkleProof(hashes, idx)
+		}
+	}
+
+	return nil, fmt.Errorf("transaction %s not found in block %d", txHash, block.Height)
+}
+
+func txHashes(block *types.Block) []string {
+	hashes := make([]string, len(block.Transactions))
+	for idx, tx := range block.Transactions {
+		hashes[idx] = tx.Hash
+	}
+	return hashes
+}
+
+func writeUint64(h hash.Hash, value uint64) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	h.Write(buf)
+}
+
+// writeBytes writes a length-prefixed byte slice, so adjacent fields can't collide
+func writeBytes(h hash.Hash, data []byte) {
+	writeUint64(h, uint64(len(data)))
+	h.Write(data)
+}
+
+func writeString(h hash.Hash, value string) {
+	writeBytes(h, []byte(value))
+}
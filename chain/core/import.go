@@ -0,0 +1,134 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// Importer appends blocks produced elsewhere to the store. Every block must be
+// valid and follow the tip, and its transactions are replayed on the account
+// state, so the node can continue the chain from the imported blocks.
+type Importer struct {
+	store    Store
+	genesis  *Genesis
+	tip      *types.Block
+	state    *State
+	producer ed25519.PublicKey
+}
+
+// NewImporter returns an importer of blocks signed with the producer public key.
+// Without a key, all blocks must be signed by the producer of the store tip, or
+// of the first imported block on an empty store.
+func NewImporter(store Store, producer ed25519.PublicKey) (*Importer, error) {
+	state, genesis, err := initialState(store)
+	if err != nil {
+		return nil, err
+	}
+
+	importer := &Importer{store: store, genesis: genesis, producer: producer}
+
+	tip := store.TipHeight()
+	if tip == 0 {
+		importer.state = state
+		return importer, nil
+	}
+
+	block, err := store.ReadBlock(tip)
+	if err != nil {
+		return nil, fmt.Errorf("cant read tip block %d: %v", tip, err)
+	}
+
+	state, err = store.ReadState()
+	if err != nil {
+		return nil, fmt.Errorf("cant read account state: %v", err)
+	}
+	if state.Height != tip || (state.Hash != "" && state.Hash != block.Hash) {
+		return nil, fmt.Errorf("account state at height %d does not match the tip block %d", state.Height, tip)
+	}
+
+	if err := VerifyBlock(block, producer); err != nil {
+		return nil, fmt.Errorf("tip block %d verification failed: %v", tip, err)
+	}
+	if importer.producer == nil {
+		importer.producer = blockPublicKey(block)
+	}
+
+	importer.tip = block
+	importer.state = state
+
+	return importer, nil
+}
+
+// Tip returns the last block of the store, nil when the store is empty
+func (importer *Importer) Tip() *types.Block {
+	return importer.tip
+}
+
+// Import verifies the block, applies its transactions and writes it to the store
+func (importer *Importer) Import(block *types.Block) error {
+	if tip := importer.tip; tip != nil {
+		if block.Height != tip.Height+1 {
+			return fmt.Errorf("block %d does not follow the tip %d", block.Height, tip.Height)
+		}
+		if block.PrevHash != tip.Hash {
+			return fmt.Errorf("block %d does not link to the tip %s", block.Height, tip.Hash)
+		}
+		if !block.Timestamp.After(tip.Timestamp) {
+			return fmt.Errorf("block %d timestamp is not after the tip timestamp", block.Height)
+		}
+	} else if importer.genesis != nil {
+		if err := checkGenesisLink(importer.genesis, block); err != nil {
+			return err
+		}
+	}
+
+	if err := VerifyBlock(block, importer.producer); err != nil {
+		return fmt.Errorf("block %d verification failed: %v", block.Height, err)
+	}
+	if importer.producer == nil {
+		importer.producer = blockPublicKey(block)
+	}
+
+	state, err := replayBlock(importer.state, block)
+	if err != nil {
+		return err
+	}
+
+	if err := importer.store.WriteBlock(block); err != nil {
+		return err
+	}
+	if err := importer.store.WriteState(state); err != nil {
+		return err
+	}
+
+	importer.tip = block
+	importer.state = state
+
+	return nil
+}
+
+// replayBlock returns the account state after the block transactions are applied
+// on the given state, which is left untouched
+func replayBlock(parentState *State, block *types.Block) (*State, error) {
+	state := parentState.Clone()
+	state.Height = block.Height
+	state.Hash = block.Hash
+
+	for idx := range block.Transactions {
+		// The result is recorded in the block, the copy only checks it
+		tx := block.Transactions[idx]
+
+		if HashTransaction(&tx) != tx.Hash {
+			return nil, fmt.Errorf("block %d transaction %d has an invalid hash", block.Height, idx)
+		}
+
+		state.ApplyTransaction(&tx)
+		if tx.Success != block.Transactions[idx].Success {
+			return nil, fmt.Errorf("block %d transaction %s result does not match the account state", block.Height, tx.Hash)
+		}
+	}
+
+	return state, nil
+}
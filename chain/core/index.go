@@ -0,0 +1,478 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+const indexFilename = "index.db"
+
+// Number of blocks indexed in a single database transaction when catching up
+const indexBatchSize = 1000
+
+var (
+	// Block hash -> height
+	indexBucketHashes = []byte("hashes")
+
+	// Transaction hash -> height and index in the block
+	indexBucketTxs = []byte("txs")
+
+	// Address, height and transaction index -> nothing, ordered by height for every address
+	indexBucketAddresses = []byte("addresses")
+
+	// Height -> everything indexed for the block, so it can be removed without the block
+	indexBucketHeights = []byte("heights")
+
+	indexBucketMeta = []byte("meta")
+	indexKeyTip     = []byte("tip")
+)
+
+// Index keeps lookups by block hash, transaction hash and address for the stored
+// chain. It lives next to the store blocks and works with any store backend.
+type Index struct {
+	db *bolt.DB
+}
+
+// indexedBlock records the index entries of a single block
+type indexedBlock struct {
+	Hash string      `json:"hash"`
+	Txs  []indexedTx `json:"txs"`
+}
+
+type indexedTx struct {
+	Hash     string `json:"hash"`
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+}
+
+// TxLocation points to a transaction in the chain
+type TxLocation struct {
+	Height uint64
+	Index  int
+}
+
+func OpenIndex(dir string) (*Index, error) {
+	path := filepath.Join(dir, indexFilename)
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cant open index %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexBucketHashes, indexBucketTxs, indexBucketAddresses, indexBucketHeights, indexBucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Index{db: db}, nil
+}
+
+// RemoveIndex deletes the index database in given directory
+func RemoveIndex(dir string) error {
+	err := os.Remove(filepath.Join(dir, indexFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (index *Index) Close() error {
+	return index.db.Close()
+}
+
+// Tip returns the height of the last indexed block
+func (index *Index) Tip() (uint64, error) {
+	tip := uint64(0)
+
+	err := index.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(indexBucketMeta).Get(indexKeyTip); value != nil {
+			tip = binary.BigEndian.Uint64(value)
+		}
+		return nil
+	})
+
+	return tip, err
+}
+
+// Add indexes blocks following the index tip
+func (index *Index) Add(blocks ...*types.Block) error {
+	return index.db.Update(func(tx *bolt.Tx) error {
+		for _, block := range blocks {
+			if err := index.add(tx, block); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Truncate removes entries of all blocks above given height
+func (index *Index) Truncate(height uint64) error {
+	return index.db.Update(func(tx *bolt.Tx) error {
+		return index.truncate(tx, height)
+	})
+}
+
+// Prune removes entries of all blocks below given height
+func (index *Index) Prune(height uint64) error {
+	return index.db.Update(func(tx *bolt.Tx) error {
+		heights := []uint64{}
+
+		cursor := tx.Bucket(indexBucketHeights).Cursor()
+		for key, _ := cursor.First(); key != nil && binary.BigEndian.Uint64(key) < height; key, _ = cursor.Next() {
+			heights = append(heights, binary.BigEndian.Uint64(key))
+		}
+
+		// Entries are removed after the walk, the cursor can't skip deleted keys
+		for _, h := range heights {
+			if err := index.remove(tx, h); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// BlockHash returns the hash of the indexed block at given height
+func (index *Index) BlockHash(height uint64) (string, error) {
+	hash := ""
+
+	err := index.db.View(func(tx *bolt.Tx) error {
+		entry, err := readIndexedBlock(tx, height)
+		if entry != nil {
+			hash = entry.Hash
+		}
+		return err
+	})
+
+	return hash, err
+}
+
+// BlockHeight returns the height of the block with given hash
+func (index *Index) BlockHeight(hash string) (uint64, bool, error) {
+	var height uint64
+	found := false
+
+	err := index.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(indexBucketHashes).Get([]byte(hash)); value != nil {
+			height = binary.BigEndian.Uint64(value)
+			found = true
+		}
+		return nil
+	})
+
+	return height, found, err
+}
+
+// Transaction returns the location of the transaction with given hash
+func (index *Index) Transaction(hash string) (*TxLocation, error) {
+	var loc *TxLocation
+
+	err := index.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(indexBucketTxs).Get([]byte(hash)); value != nil {
+			loc = &TxLocation{
+				Height: binary.BigEndian.Uint64(value[0:8]),
+				Index:  int(binary.BigEndian.Uint32(value[8:12])),
+			}
+		}
+		return nil
+	})
+
+	return loc, err
+}
+
+// AddressTransactions returns locations of transactions sent or received by the
+// address below given height (0 for no limit), the most recent first.
+func (index *Index) AddressTransactions(address string, before uint64, limit int) ([]TxLocation, error) {
+	locs := []TxLocation{}
+
+	prefix := addressKeyPrefix(address)
+	if before == 0 {
+		before = ^uint64(0)
+	}
+
+	seek := append(append([]byte{}, prefix...), uint64Bytes(before)...)
+
+	err := index.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(indexBucketAddresses).Cursor()
+
+		// Seek lands on the first key at or after the height, so step back from there
+		key, _ := cursor.Seek(seek)
+		if key == nil {
+			key, _ = cursor.Last()
+		} else {
+			key, _ = cursor.Prev()
+		}
+
+		for ; key != nil && bytes.HasPrefix(key, prefix) && len(locs) < limit; key, _ = cursor.Prev() {
+			rest := key[len(prefix):]
+			locs = append(locs, TxLocation{
+				Height: binary.BigEndian.Uint64(rest[0:8]),
+				Index:  int(binary.BigEndian.Uint32(rest[8:12])),
+			})
+		}
+
+		return nil
+	})
+
+	return locs, err
+}
+
+// Sync brings the index in line with the store after a crash or a rollback.
+// Entries of blocks that are no longer in the store are removed, and the
+// missing blocks are indexed.
+func (index *Index) Sync(store Store) error {
+	indexTip, err := index.Tip()
+	if err != nil {
+		return err
+	}
+
+	storeTip := store.TipHeight()
+	start := store.StartHeight()
+
+	// Blocks below the start were pruned
+	if err := index.Prune(start); err != nil {
+		return err
+	}
+
+	// Find the highest block indexed with the same hash as the stored one
+	common := indexTip
+	if common > storeTip {
+		common = storeTip
+	}
+
+	for common > 0 && common >= start {
+		hash, err := index.BlockHash(common)
+		if err != nil {
+			return err
+		}
+
+		if hash != "" {
+			block, err := store.ReadBlock(common)
+			if err != nil {
+				return err
+			}
+			if block.Hash == hash {
+				break
+			}
+		}
+
+		common--
+	}
+
+	if common < start {
+		common = 0
+	}
+
+	if common < indexTip {
+		logrus.
+			WithField("from", common+1).
+			WithField("to", indexTip).
+			Warn("removing index entries of blocks that are not in the store")
+
+		if err := index.Truncate(common); err != nil {
+			return err
+		}
+	}
+
+	from := common + 1
+	if from < start {
+		from = start
+	}
+
+	if storeTip == 0 || from > storeTip {
+		return nil
+	}
+
+	logrus.
+		WithField("from", from).
+		WithField("to", storeTip).
+		Info("indexing blocks")
+
+	return index.Build(store, from)
+}
+
+// Build indexes all stored blocks starting at given height
+func (index *Index) Build(store Store, from uint64) error {
+	tip := store.TipHeight()
+	lastReport := time.Now()
+
+	for height := from; height <= tip; {
+		batch := []*types.Block{}
+
+		for ; height <= tip && len(batch) < indexBatchSize; height++ {
+			block, err := store.ReadBlock(height)
+			if err != nil {
+				return fmt.Errorf("cant read block %d: %v", height, err)
+			}
+			batch = append(batch, block)
+		}
+
+		if err := index.Add(batch...); err != nil {
+			return err
+		}
+
+		if time.Since(lastReport) >= progressReportInterval {
+			lastReport = time.Now()
+			logrus.WithField("height", height-1).WithField("tip", tip).Info("indexing progress")
+		}
+	}
+
+	return nil
+}
+
+func (index *Index) add(tx *bolt.Tx, block *types.Block) error {
+	// Replacing a block at or below the tip removes the entries of the previous ones
+	if tip := readIndexTip(tx); tip > 0 && block.Height <= tip {
+		if err := index.truncate(tx, block.Height-1); err != nil {
+			return err
+		}
+	}
+
+	height := uint64Bytes(block.Height)
+
+	if err := tx.Bucket(indexBucketHashes).Put([]byte(block.Hash), height); err != nil {
+		return err
+	}
+
+	entry := indexedBlock{Hash: block.Hash, Txs: make([]indexedTx, len(block.Transactions))}
+
+	for idx, t := range block.Transactions {
+		loc := txLocationBytes(block.Height, idx)
+
+		if err := tx.Bucket(indexBucketTxs).Put([]byte(t.Hash), loc); err != nil {
+			return err
+		}
+
+		for _, addr := range txAddresses(&t) {
+			if err := tx.Bucket(indexBucketAddresses).Put(addressKey(addr, block.Height, idx), nil); err != nil {
+				return err
+			}
+		}
+
+		entry.Txs[idx] = indexedTx{Hash: t.Hash, Sender: t.Sender, Receiver: t.Receiver}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(indexBucketHeights).Put(height, data); err != nil {
+		return err
+	}
+
+	return tx.Bucket(indexBucketMeta).Put(indexKeyTip, height)
+}
+
+func (index *Index) truncate(tx *bolt.Tx, height uint64) error {
+	tip := readIndexTip(tx)
+
+	for h := tip; h > height; h-- {
+		if err := index.remove(tx, h); err != nil {
+			return err
+		}
+	}
+
+	if height >= tip {
+		return nil
+	}
+
+	return tx.Bucket(indexBucketMeta).Put(indexKeyTip, uint64Bytes(height))
+}
+
+// remove deletes all entries of the block at given height
+func (index *Index) remove(tx *bolt.Tx, height uint64) error {
+	entry, err := readIndexedBlock(tx, height)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	// A hash or transaction replayed at another height belongs to that height now
+	if value := tx.Bucket(indexBucketHashes).Get([]byte(entry.Hash)); value != nil && binary.BigEndian.Uint64(value) == height {
+		if err := tx.Bucket(indexBucketHashes).Delete([]byte(entry.Hash)); err != nil {
+			return err
+		}
+	}
+
+	for idx, t := range entry.Txs {
+		if value := tx.Bucket(indexBucketTxs).Get([]byte(t.Hash)); value != nil && bytes.Equal(value, txLocationBytes(height, idx)) {
+			if err := tx.Bucket(indexBucketTxs).Delete([]byte(t.Hash)); err != nil {
+				return err
+			}
+		}
+
+		for _, addr := range txAddresses(&types.Transaction{Sender: t.Sender, Receiver: t.Receiver}) {
+			if err := tx.Bucket(indexBucketAddresses).Delete(addressKey(addr, height, idx)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket(indexBucketHeights).Delete(uint64Bytes(height))
+}
+
+func readIndexTip(tx *bolt.Tx) uint64 {
+	if value := tx.Bucket(indexBucketMeta).Get(indexKeyTip); value != nil {
+		return binary.BigEndian.Uint64(value)
+	}
+	return 0
+}
+
+func readIndexedBlock(tx *bolt.Tx, height uint64) (*indexedBlock, error) {
+	data := tx.Bucket(indexBucketHeights).Get(uint64Bytes(height))
+	if data == nil {
+		return nil, nil
+	}
+
+	entry := &indexedBlock{}
+	return entry, json.Unmarshal(data, entry)
+}
+
+// txAddresses returns the distinct addresses touched by the transaction
+func txAddresses(tx *types.Transaction) []string {
+	if tx.Sender == tx.Receiver {
+		return []string{tx.Sender}
+	}
+	return []string{tx.Sender, tx.Receiver}
+}
+
+func addressKeyPrefix(address string) []byte {
+	return append([]byte(address), 0)
+}
+
+func addressKey(address string, height uint64, idx int) []byte {
+	return append(addressKeyPrefix(address), txLocationBytes(height, idx)...)
+}
+
+func txLocationBytes(height uint64, idx int) []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint64(data[0:8], height)
+	binary.BigEndian.PutUint32(data[8:12], uint32(idx))
+	return data
+}
+
+func uint64Bytes(value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return data
+}
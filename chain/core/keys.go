@@ -0,0 +1,250 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+	"github.com/sirupsen/logrus"
+)
+
+const producerKeyFilename = "producer_key.json"
+
+var (
+	ErrInvalidBlockHash      = errors.New("block hash does not match the header")
+	ErrInvalidBlockProducer  = errors.New("block producer does not match the public key")
+	ErrInvalidBlockSignature = errors.New("invalid block signature")
+	ErrInvalidTxHash         = errors.New("transaction hash does not match its content")
+	ErrInvalidTxRoot         = errors.New("transaction root does not match the transactions")
+	ErrUnexpectedProducer    = errors.New("block is signed by another producer")
+)
+
+// ProducerKey is an Ed25519 keypair used for signing block headers
+type ProducerKey struct {
+	Address    string             `json:"address"`
+	PublicKey  ed25519.PublicKey  `json:"-"`
+	PrivateKey ed25519.PrivateKey `json:"-"`
+}
+
+type producerKeyFile struct {
+	Address    string `json:"address"`
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+}
+
+// GenerateProducerKey creates a new random producer keypair
+func GenerateProducerKey() (*ProducerKey, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProducerKey{
+		Address:    ProducerAddress(pub),
+		PublicKey:  pub,
+		PrivateKey: priv,
+	}, nil
+}
+
+// DeriveProducerKey returns the producer keypair for a deterministic chain seed
+func DeriveProducerKey(seed int64) *ProducerKey {
+	keySeed := sha256.Sum256([]byte(fmt.Sprintf("producer:%d", seed)))
+	priv := ed25519.NewKeyFromSeed(keySeed[:])
+	pub := priv.Public().(ed25519.PublicKey)
+
+	return &ProducerKey{
+		Address:    ProducerAddress(pub),
+		PublicKey:  pub,
+		PrivateKey: priv,
+	}
+}
+
+// LoadOrCreateProducerKey reads the producer key from the store directory,
+// and generates a new one when it does not exist yet. With a non-zero seed the
+// key is derived from the seed, and an existing key must match it.
+func LoadOrCreateProducerKey(dir string, seed int64) (*ProducerKey, error) {
+	path := filepath.Join(dir, producerKeyFilename)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		var key *ProducerKey
+		if seed != 0 {
+			key = DeriveProducerKey(seed)
+		} else {
+			key, err = GenerateProducerKey()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		logrus.
+			WithField("path", path).
+			WithField("address", key.Address).
+			Info("generated new producer key")
+
+		return key, writeProducerKey(path, key)
+	}
+
+	key, err := readProducerKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if seed != 0 && key.Address != DeriveProducerKey(seed).Address {
+		return nil, fmt.Errorf("producer key in %s was not derived from seed %d", path, seed)
+	}
+
+	return key, nil
+}
+
+// LoadProducerKey reads the producer key from the store directory without creating
+// it. A missing key is derived from a non-zero seed, nil is returned otherwise.
+func LoadProducerKey(dir string, seed int64) (*ProducerKey, error) {
+	path := filepath.Join(dir, producerKeyFilename)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if seed != 0 {
+			return DeriveProducerKey(seed), nil
+		}
+		return nil, nil
+	}
+
+	key, err := readProducerKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if seed != 0 && key.Address != DeriveProducerKey(seed).Address {
+		return nil, fmt.Errorf("producer key in %s was not derived from seed %d", path, seed)
+	}
+
+	return key, nil
+}
+
+// ProducerAddress returns the producer address derived from the public key
+func ProducerAddress(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "0x" + hex.EncodeToString(sum[:20])
+}
+
+// SignBlock sets the producer and signs the block header
+func SignBlock(block *types.Block, key *ProducerKey) error {
+	hash, err := hex.DecodeString(block.Hash)
+	if err != nil {
+		return err
+	}
+
+	block.PublicKey = hex.EncodeToString(key.PublicKey)
+	block.Signature = hex.EncodeToString(ed25519.Sign(key.PrivateKey, hash))
+
+	return nil
+}
+
+// VerifyBlock checks the block hash, the transactions it commits to and the
+// producer signature. The block must be signed with the producer public key,
+// unless it is nil.
+func VerifyBlock(block *types.Block, producer ed25519.PublicKey) error {
+	if hash := HashBlock(block); hash != block.Hash {
+		return fmt.Errorf("%w: hash is %s, expected %s", ErrInvalidBlockHash, block.Hash, hash)
+	}
+
+	for idx, tx := range block.Transactions {
+		if hash := HashTransaction(&tx); hash != tx.Hash {
+			return fmt.Errorf("%w: transaction %d hash is %s, expected %s", ErrInvalidTxHash, idx, tx.Hash, hash)
+		}
+	}
+
+	root, err := TxRoot(block)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTxRoot, err)
+	}
+	if root != block.TxRoot {
+		return fmt.Errorf("%w: root is %s, expected %s", ErrInvalidTxRoot, block.TxRoot, root)
+	}
+
+	pub, err := hex.DecodeString(block.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key: %q", block.PublicKey)
+	}
+
+	if producer != nil && !producer.Equal(ed25519.PublicKey(pub)) {
+		return fmt.Errorf("%w: public key is %s, expected %s", ErrUnexpectedProducer, block.PublicKey, hex.EncodeToString(producer))
+	}
+
+	if ProducerAddress(pub) != block.Producer {
+		return ErrInvalidBlockProducer
+	}
+
+	hash, err := hex.DecodeString(block.Hash)
+	if err != nil {
+		return err
+	}
+
+	sig, err := hex.DecodeString(block.Signature)
+	if err != nil {
+		return ErrInvalidBlockSignature
+	}
+
+	if !ed25519.Verify(pub, hash, sig) {
+		return ErrInvalidBlockSignature
+	}
+
+	return nil
+}
+
+// blockPublicKey returns the public key the block is signed with, nil when invalid
+func blockPublicKey(block *types.Block) ed25519.PublicKey {
+	pub, err := hex.DecodeString(block.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil
+	}
+	return pub
+}
+
+func readProducerKey(path string) (*ProducerKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := producerKeyFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	priv, err := hex.DecodeString(file.PrivateKey)
+	if err != nil || len(priv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key in %s", path)
+	}
+
+	key := &ProducerKey{
+		PrivateKey: priv,
+		PublicKey:  ed25519.PrivateKey(priv).Public().(ed25519.PublicKey),
+	}
+	key.Address = ProducerAddress(key.PublicKey)
+
+	if key.Address != file.Address {
+		return nil, fmt.Errorf("producer address in %s does not match the key", path)
+	}
+
+	return key, nil
+}
+
+func writeProducerKey(path string, key *ProducerKey) error {
+	data, err := json.MarshalIndent(producerKeyFile{
+		Address:    key.Address,
+		PublicKey:  hex.EncodeToString(key.PublicKey),
+		PrivateKey: hex.EncodeToString(key.PrivateKey),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0600)
+}
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+var (
+	ErrMempoolFull     = errors.New("mempool is full")
+	ErrTxKnown         = errors.New("transaction is already in the mempool")
+	ErrTxNonceTooLow   = errors.New("transaction nonce is too low")
+	ErrTxInvalidAmount = errors.New("transaction amount and fee must not be negative")
+	ErrTxMissingParty  = errors.New("transaction sender and receiver are required")
+)
+
+// MempoolConfig controls the transaction pool limits
+type MempoolConfig struct {
+	// Maximum number of pending transactions
+	Size int
+
+	// Maximum number of pool transactions included in a single block
+	BlockLimit int
+}
+
+func (c MempoolConfig) Validate() error {
+	if c.Size < 1 {
+		return errors.New("mempool size must be greater than 0")
+	}
+	if c.BlockLimit < 1 {
+		return errors.New("block transactions limit must be greater than 0")
+	}
+	return nil
+}
+
+type mempoolTx struct {
+	tx  types.Transaction
+	seq uint64
+}
+
+// Mempool holds submitted transactions until they are included in a block.
+// Transactions are ordered by fee, and by submission order for equal fees.
+type Mempool struct {
+	config MempoolConfig
+
+	lock sync.Mutex
+	txs  map[string]*mempoolTx
+	seq  uint64
+}
+
+func NewMempool(config MempoolConfig) *Mempool {
+	return &Mempool{
+		config: config,
+		txs:    map[string]*mempoolTx{},
+	}
+}
+
+// Add validates the transaction against the given state and adds it to the pool
+func (m *Mempool) Add(tx types.Transaction, state *State) (string, error) {
+	if tx.Type == "" {
+		tx.Type = "transfer"
+	}
+	if tx.Sender == "" || tx.Receiver == "" {
+		return "", ErrTxMissingParty
+	}
+	if tx.Amount == nil {
+		tx.Amount = big.NewInt(0)
+	}
+	if tx.Fee == nil {
+		tx.Fee = big.NewInt(0)
+	}
+	if tx.Amount.Sign() < 0 || tx.Fee.Sign() < 0 {
+		return "", ErrTxInvalidAmount
+	}
+
+	if nonce := state.Nonce(tx.Sender); tx.Nonce < nonce {
+		return "", fmt.Errorf("%w: got %d, expected at least %d", ErrTxNonceTooLow, tx.Nonce, nonce)
+	}
+
+	cost := new(big.Int).Add(tx.Amount, tx.Fee)
+	if state.Balance(tx.Sender).Cmp(cost) < 0 {
+		return "", ErrInsufficientFunds
+	}
+
+	tx.Hash = HashTransaction(&tx)
+	tx.Success = false
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.txs[tx.Hash]; ok {
+		return "", ErrTxKnown
+	}
+	if len(m.txs) >= m.config.Size {
+		return "", ErrMempoolFull
+	}
+
+	m.seq++
+	m.txs[tx.Hash] = &mempoolTx{tx: tx, seq: m.seq}
+
+	return tx.Hash, nil
+}
+
+// Drain removes and returns executable transactions for the next block.
+// Transactions with a stale nonce are dropped, the ones with a nonce gap stay in the pool.
+func (m *Mempool) Drain(state *State) []types.Transaction {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	pending := make([]*mempoolTx, 0, len(m.txs))
+	for _, mtx := range m.txs {
+		pending = append(pending, mtx)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		if cmp := pending[i].tx.Fee.Cmp(pending[j].tx.Fee); cmp != 0 {
+			return cmp > 0
+		}
+		return pending[i].seq < pending[j].seq
+	})
+
+	nonces := map[string]uint64{}
+	result := []types.Transaction{}
+
+	// Including a transaction may unlock the next nonce of the same sender,
+	// so keep scanning until nothing else can be included.
+	for progress := true; progress && len(result) < m.config.BlockLimit; {
+		progress = false
+
+		for _, mtx := range pending {
+			if len(result) == m.config.BlockLimit {
+				break
+			}
+
+			tx := mtx.tx
+			if _, ok := m.txs[tx.Hash]; !ok {
+				continue
+			}
+
+			nonce, ok := nonces[tx.Sender]
+			if !ok {
+				nonce = state.Nonce(tx.Sender)
+			}
+
+			switch {
+			case tx.Nonce < nonce:
+				delete(m.txs, tx.Hash)
+			case tx.Nonce == nonce:
+				delete(m.txs, tx.Hash)
+				nonces[tx.Sender] = nonce + 1
+				result = append(result, tx)
+				progress = true
+			}
+		}
+	}
+
+	return result
+}
+
+// Readd returns transactions from abandoned blocks back to the pool
+func (m *Mempool) Readd(txs []types.Transaction) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, tx := range txs {
+		if _, ok := m.txs[tx.Hash]; ok {
+			continue
+		}
+
+		tx.Success = false
+		m.seq++
+		m.txs[tx.Hash] = &mempoolTx{tx: tx, seq: m.seq}
+	}
+}
+
+// Size returns the number of pending transactions
+func (m *Mempool) Size() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.txs)
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Domain separation prefixes for merkle tree hashing (RFC 6962)
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProof proves the inclusion of a leaf in a merkle tree
+type MerkleProof struct {
+	Index int               `json:"index"`
+	Leaf  string            `json:"leaf"`
+	Root  string            `json:"root"`
+	Path  []MerkleProofStep `json:"path"`
+}
+
+// MerkleProofStep is a sibling hash on the path from the leaf to the root
+type MerkleProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleRoot returns the root of the merkle tree built from hex-encoded leaves
+func MerkleRoot(leaves []string) (string, error) {
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return hex.EncodeToString(empty[:]), nil
+	}
+
+	level, err := merkleLeaves(leaves)
+	if err != nil {
+		return "", err
+	}
+
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+
+	return hex.EncodeToString(level[0]), nil
+}
+
+// NewMerkleProof builds an inclusion proof for the leaf at given index
+func NewMerkleProof(leaves []string, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, errors.New("leaf index is out of range")
+	}
+
+	level, err := merkleLeaves(leaves)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &MerkleProof{
+		Index: index,
+		Leaf:  leaves[index],
+	}
+
+	pos := index
+	for len(level) > 1 {
+		sibling := pos ^ 1
+		if sibling < len(level) {
+			proof.Path = append(proof.Path, MerkleProofStep{
+				Hash: hex.EncodeToString(level[sibling]),
+				Left: sibling < pos,
+			})
+		}
+
+		level = merkleLevel(level)
+		pos /= 2
+	}
+
+	proof.Root = hex.EncodeToString(level[0])
+	return proof, nil
+}
+
+// Verify checks that the proof path leads from the leaf to the root
+func (p *MerkleProof) Verify() bool {
+	leaf, err := hex.DecodeString(p.Leaf)
+	if err != nil {
+		return false
+	}
+
+	current := merkleHash(merkleLeafPrefix, leaf)
+	for _, step := range p.Path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+
+		if step.Left {
+			current = merkleHash(merkleNodePrefix, sibling, current)
+		} else {
+			current = merkleHash(merkleNodePrefix, current, sibling)
+		}
+	}
+
+	return hex.EncodeToString(current) == p.Root
+}
+
+func merkleLeaves(leaves []string) ([][]byte, error) {
+	level := make([][]byte, len(leaves))
+
+	for i, leaf := range leaves {
+		data, err := hex.DecodeString(leaf)
+		if err != nil {
+			return nil, err
+		}
+		level[i] = merkleHash(merkleLeafPrefix, data)
+	}
+
+	return level, nil
+}
+
+// merkleLevel hashes pairs of nodes, an odd node is promoted to the next level
+func merkleLevel(nodes [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(nodes)+1)/2)
+
+	for i := 0; i < len(nodes); i += 2 {
+		if i+1 == len(nodes) {
+			next = append(next, nodes[i])
+			continue
+		}
+		next = append(next, merkleHash(merkleNodePrefix, nodes[i], nodes[i+1]))
+	}
+
+	return next
+}
+
+func merkleHash(prefix byte, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
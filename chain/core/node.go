@@ -2,36 +2,102 @@ package core
 
 import (
 	"context"
+	"crypto/ed25519"
+	"fmt"
+	"time"
 
 	"github.com/figment-networks/graph-instrumentation-example/chain/deepmind"
 	"github.com/figment-networks/graph-instrumentation-example/chain/types"
 	"github.com/sirupsen/logrus"
 )
 
+// How often the progress of long running operations is logged
+const progressReportInterval = 5 * time.Second
+
+// Minimum number of blocks past the retention removed at once
+const pruneBatchSize = 100
+
+// Number of generated blocks synced to disk at once
+const generateBatchSize = 1000
+
 type Node struct {
-	engine Engine
-	store  Store
+	engine  Engine
+	store   Store
+	mempool *Mempool
+	feed    *BlockFeed
+
+	// Current canonical chain head
+	tip *types.Block
+
+	// Blocks received on competing branches, by hash
+	sideBlocks map[string]*types.Block
+
+	// Rollback not yet announced in the DeepMind output
+	rollback *Rollback
+
+	// Rollback announced, its record is removed once the replacement block is stored
+	rollbackAnnounced bool
+
+	// Seed of the deterministic mode, zero when disabled
+	seed int64
+
+	// Network of the node, nil when the chain is configured with flags only
+	genesis *Genesis
+
+	// Number of most recent blocks kept in the store, zero keeps all blocks
+	retainBlocks uint64
+
+	// Handling of DeepMind output failures
+	emitConfig EmitConfig
+
+	// Level of the per-block log messages
+	blockLogLevel logrus.Level
+
+	// Blocks are written in a store batch, the state is only written when it ends
+	batching bool
 }
 
-func NewNode(storeDir string, blockRate int, genesisHeight uint64) *Node {
+func NewNode(store Store, blockTime time.Duration, genesisHeight uint64, forkConfig ForkConfig, finalityConfig FinalityConfig, mempoolConfig MempoolConfig, seed int64) *Node {
+	mempool := NewMempool(mempoolConfig)
+
 	return &Node{
-		engine: NewEngine(genesisHeight, blockRate),
-		store:  NewStore(storeDir),
+		engine:        NewEngine(genesisHeight, blockTime, forkConfig, finalityConfig, mempool, seed),
+		store:         store,
+		mempool:       mempool,
+		feed:          NewBlockFeed(),
+		sideBlocks:    map[string]*types.Block{},
+		seed:          seed,
+		emitConfig:    EmitConfig{Policy: EmitPolicyHalt},
+		blockLogLevel: logrus.InfoLevel,
 	}
 }
 
 func (node *Node) Initialize() error {
 	logrus.Info("initializing node")
 
+	if err := node.mempool.config.Validate(); err != nil {
+		return err
+	}
+
 	logrus.Info("initializing store")
 	if err := node.store.Initialize(); err != nil {
 		logrus.WithError(err).Error("store initialization failed")
 		return err
 	}
 
-	var tipBlock *types.Block
+	logrus.Info("loading producer key")
+	producerKey, err := LoadOrCreateProducerKey(node.store.Dir(), node.seed)
+	if err != nil {
+		logrus.WithError(err).Error("cant load producer key")
+		return err
+	}
+
+	var (
+		tipBlock *types.Block
+		tipState *State
+	)
 
-	if tip := node.store.meta.TipHeight; tip > 0 {
+	if tip := node.store.TipHeight(); tip > 0 {
 		logrus.WithField("tip", tip).Info("loading last block")
 		block, err := node.store.ReadBlock(tip)
 		if err != nil {
@@ -39,36 +105,100 @@ func (node *Node) Initialize() error {
 			return err
 		}
 		tipBlock = block
+
+		if err := VerifyBlock(block, producerKey.PublicKey); err != nil {
+			logrus.WithError(err).Error("last block verification failed")
+			return fmt.Errorf("block %d verification failed: %v", tip, err)
+		}
+
+		logrus.WithField("tip", tip).Info("loading account state")
+		state, err := node.store.ReadState()
+		if err != nil {
+			logrus.WithError(err).Error("cant read account state")
+			return err
+		}
+		if state.Height != tip {
+			return fmt.Errorf("account state height %d does not match tip height %d", state.Height, tip)
+		}
+		if state.Hash != "" && state.Hash != block.Hash {
+			return fmt.Errorf("account state does not belong to the tip block %s", block.Hash)
+		}
+		tipState = state
+
+		if err := node.checkGenesis(producerKey.PublicKey); err != nil {
+			logrus.WithError(err).Error("store belongs to a different chain")
+			return err
+		}
+	}
+
+	rollback, err := loadRollback(node.store)
+	if err != nil {
+		logrus.WithError(err).Error("cant load rollback record")
+		return err
+	}
+	if rollback != nil {
+		logrus.
+			WithField("height", rollback.Height).
+			WithField("from", rollback.FromHeight).
+			Info("continuing the chain after a rollback")
 	}
 
 	logrus.Info("initializing engine")
-	if err := node.engine.Initialize(tipBlock); err != nil {
+	if err := node.engine.Initialize(tipBlock, tipState, producerKey); err != nil {
 		logrus.WithError(err).Error("engine initialization failed")
 		return err
 	}
 
+	if rollback != nil {
+		node.engine.abandoned = rollback.AbandonedHash
+	}
+
+	node.rollback = rollback
+
+	node.tip = tipBlock
+
 	return nil
 }
 
 func (node *Node) Start(ctx context.Context) error {
-	go node.engine.StartBlockProduction(ctx)
+	if node.tip == nil && node.genesis != nil {
+		if wait := time.Until(node.genesis.GenesisTime); wait > 0 {
+			logrus.WithField("genesis_time", node.genesis.GenesisTime).Info("waiting for genesis time")
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+
+	produceErr := make(chan error, 1)
+	go func() {
+		produceErr <- node.engine.StartBlockProduction(ctx)
+	}()
 
 	for {
 		select {
 		case block, ok := <-node.engine.Subscription():
 			if !ok {
-				return nil
+				return <-produceErr
+			}
+
+			// The block is only stored once emitted, a node halted by the emit
+			// policy produces it again when restarted
+			if err := node.emitBlock(ctx, block); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				logrus.WithError(err).Error("failed to emit block")
+				return err
 			}
 			if err := node.processBlock(block); err != nil {
 				logrus.WithError(err).Error("failed to process block")
 				return err
 			}
-
-			if deepmind.Enabled {
-				deepmind.BeginBlock(block.Height)
-				deepmind.Block(block)
-				deepmind.EndBlock(block.Height)
-			}
+			node.engine.Ack()
 
 		case <-ctx.Done():
 			return nil
@@ -76,15 +206,416 @@ func (node *Node) Start(ctx context.Context) error {
 	}
 }
 
+// Generate produces blocks from the given height up to the target height as fast
+// as possible, without waiting for the block rate. When the store is empty, the
+// first height becomes the genesis height.
+func (node *Node) Generate(ctx context.Context, from uint64, to uint64) (err error) {
+	if from == 0 {
+		return fmt.Errorf("generation must start at height 1 or above, got %d", from)
+	}
+
+	next := from
+	if node.tip != nil {
+		next = node.tip.Height + 1
+	} else if node.genesis != nil {
+		next = node.genesis.GenesisHeight
+	} else {
+		node.engine.genesisHeight = from
+	}
+
+	if from != next {
+		if node.tip == nil {
+			return fmt.Errorf("generation must start at the genesis height %d", next)
+		}
+		return fmt.Errorf("generation must start at height %d, right after the store tip", next)
+	}
+	if to < from {
+		return fmt.Errorf("target height %d is below the start height %d", to, from)
+	}
+
+	logrus.
+		WithField("from", from).
+		WithField("to", to).
+		Info("generating blocks")
+
+	// Logging every block would be the bottleneck, so only the progress is reported
+	node.blockLogLevel = logrus.DebugLevel
+	defer func() { node.blockLogLevel = logrus.InfoLevel }()
+
+	// Blocks are synced and the state written once per batch rather than for
+	// every block, a crash loses at most the blocks of the unfinished batch
+	node.beginBatch()
+	defer func() {
+		if batchErr := node.endBatch(); err == nil {
+			err = batchErr
+		}
+	}()
+
+	started := time.Now()
+	lastReport := started
+	batched := 0
+
+	for node.tip == nil || node.tip.Height < to {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		blocks, err := node.engine.produceBlocks()
+		if err != nil {
+			logrus.WithError(err).Error("failed to produce block")
+			return err
+		}
+
+		for _, block := range blocks {
+			if err := node.emitBlock(ctx, block); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logrus.WithError(err).Error("failed to emit block")
+				return err
+			}
+			if err := node.processBlock(block); err != nil {
+				logrus.WithError(err).Error("failed to process block")
+				return err
+			}
+			batched++
+		}
+
+		if batched >= generateBatchSize {
+			if err := node.endBatch(); err != nil {
+				logrus.WithError(err).Error("failed to sync blocks")
+				return err
+			}
+			node.beginBatch()
+			batched = 0
+		}
+
+		if time.Since(lastReport) >= progressReportInterval {
+			lastReport = time.Now()
+
+			logrus.
+				WithField("height", node.tip.Height).
+				WithField("remaining", to-node.tip.Height).
+				Info("generation progress")
+		}
+	}
+
+	elapsed := time.Since(started)
+	count := to - from + 1
+
+	logrus.
+		WithField("count", count).
+		WithField("elapsed", elapsed.Round(time.Millisecond)).
+		WithField("rate", fmt.Sprintf("%.0f/s", float64(count)/elapsed.Seconds())).
+		Info("generation finished")
+
+	return nil
+}
+
+// UseClock replaces the clock used for timestamps of new blocks
+func (node *Node) UseClock(clock Clock) {
+	node.engine.UseClock(clock)
+}
+
+// UseGenesis binds the node to the network defined by the genesis
+func (node *Node) UseGenesis(genesis *Genesis) {
+	node.genesis = genesis
+	node.engine.UseGenesis(genesis)
+}
+
+// Genesis returns the network genesis, nil when the chain has no genesis file
+func (node *Node) Genesis() *Genesis {
+	return node.genesis
+}
+
+// ChainID returns the chain id of the genesis, or DefaultChainID without genesis
+func (node *Node) ChainID() string {
+	if node.genesis == nil {
+		return DefaultChainID
+	}
+	return node.genesis.ChainID
+}
+
+// UseEmitConfig sets how DeepMind output failures are handled
+func (node *Node) UseEmitConfig(config EmitConfig) {
+	node.emitConfig = config
+}
+
+// RetainBlocks enables pruning of all but the given number of most recent blocks
+func (node *Node) RetainBlocks(count uint64) {
+	node.retainBlocks = count
+}
+
+// Store returns the node block store
+func (node *Node) Store() Store {
+	return node.store
+}
+
+// SubscribeBlocks returns a channel receiving every new canonical block,
+// including the blocks of a branch the node switched to.
+func (node *Node) SubscribeBlocks(buffer int) (<-chan *types.Block, func()) {
+	return node.feed.Subscribe(buffer)
+}
+
+// SubmitTransaction validates the transaction and adds it to the mempool
+func (node *Node) SubmitTransaction(tx types.Transaction) (string, error) {
+	hash, err := node.mempool.Add(tx, node.engine.HeadState())
+	if err != nil {
+		return "", err
+	}
+
+	logrus.
+		WithField("hash", hash).
+		WithField("sender", tx.Sender).
+		WithField("nonce", tx.Nonce).
+		Debug("transaction added to mempool")
+
+	return hash, nil
+}
+
+// Account returns the account balance and nonce at the chain head
+func (node *Node) Account(addr string) Account {
+	state := node.engine.HeadState()
+
+	return Account{
+		Balance: state.Balance(addr),
+		Nonce:   state.Nonce(addr),
+	}
+}
+
 func (node *Node) processBlock(block *types.Block) error {
+	if node.tip != nil && block.PrevHash != node.tip.Hash {
+		return node.processSideBlock(block)
+	}
+
+	logrus.
+		WithField("height", block.Height).
+		WithField("hash", block.Hash).
+		WithField("lib", block.LibNum).
+		Log(node.blockLogLevel, "processing block")
+
+	if err := node.writeBlock(block); err != nil {
+		return err
+	}
+
+	node.tip = block
+	node.pruneSideBlocks()
+
+	return nil
+}
+
+// processSideBlock keeps track of blocks that do not extend the current head.
+// Once a competing branch gets longer than the canonical chain, its blocks
+// replace the abandoned ones in the store.
+func (node *Node) processSideBlock(block *types.Block) error {
 	logrus.
 		WithField("height", block.Height).
 		WithField("hash", block.Hash).
-		Info("processing block")
+		WithField("prev_hash", block.PrevHash).
+		Log(node.blockLogLevel, "processing side block")
+
+	node.sideBlocks[block.Hash] = block
+
+	if block.Height <= node.tip.Height {
+		return nil
+	}
+
+	branch := []*types.Block{block}
+	for {
+		parent, ok := node.sideBlocks[branch[0].PrevHash]
+		if !ok {
+			break
+		}
+		branch = append([]*types.Block{parent}, branch...)
+	}
+
+	base, err := node.store.ReadBlock(branch[0].Height - 1)
+	if err != nil {
+		return fmt.Errorf("cant read fork base block: %v", err)
+	}
+	if base.Hash != branch[0].PrevHash {
+		return fmt.Errorf("competing branch at height %d does not link to the canonical chain", branch[0].Height)
+	}
+	if base.Height < node.tip.LibNum {
+		return fmt.Errorf("competing branch at height %d reverts irreversible block %d", branch[0].Height, node.tip.LibNum)
+	}
+
+	logrus.
+		WithField("base_height", base.Height).
+		WithField("depth", node.tip.Height-base.Height).
+		WithField("old_tip", node.tip.Hash).
+		WithField("new_tip", block.Hash).
+		Info("switching to longer branch")
+
+	for _, b := range branch {
+		if err := node.writeBlock(b); err != nil {
+			return err
+		}
+		delete(node.sideBlocks, b.Hash)
+	}
+
+	node.tip = block
+	return nil
+}
+
+// checkGenesis makes sure the stored chain starts from the node genesis. The
+// first block is gone from pruned stores, which can't be checked.
+func (node *Node) checkGenesis(producer ed25519.PublicKey) error {
+	if node.genesis == nil || node.store.PrunedHeight() > 0 {
+		return nil
+	}
+
+	block, err := node.store.ReadBlock(node.store.StartHeight())
+	if err != nil {
+		return err
+	}
+	if err := VerifyBlock(block, producer); err != nil {
+		return fmt.Errorf("block %d verification failed: %v", block.Height, err)
+	}
+
+	return checkGenesisLink(node.genesis, block)
+}
+
+// emitBlock writes the block to the DeepMind output, failures are handled
+// according to the emit policy
+func (node *Node) emitBlock(ctx context.Context, block *types.Block) error {
+	if node.rollback != nil {
+		if err := node.emitWithPolicy(ctx, block.Height, node.emitRollback); err != nil {
+			return err
+		}
+	}
+
+	if !deepmind.Enabled {
+		return nil
+	}
+
+	// The state of the block keeps the balance changes made by its transactions
+	var balanceChanges [][]types.BalanceChange
+	if state := node.engine.State(block.Hash); state != nil {
+		balanceChanges = state.BalanceChanges
+	}
+
+	return node.emitWithPolicy(ctx, block.Height, func() error {
+		if err := deepmind.BeginBlock(block.Height); err != nil {
+			return err
+		}
+		if err := deepmind.Block(block, balanceChanges); err != nil {
+			return err
+		}
+		return deepmind.EndBlock(block.Height)
+	})
+}
+
+// emitRollback announces the rewind of the chain before the first block built
+// on top of the rollback height. It is not announced again once written, and
+// announced again after a restart until the replacement block is stored.
+func (node *Node) emitRollback() error {
+	rollback := node.rollback
+
+	if deepmind.Enabled {
+		if err := deepmind.Rollback(rollback.Height, rollback.Hash, rollback.FromHeight); err != nil {
+			return err
+		}
+	} else {
+		logrus.Warn("deepmind output is disabled, the rollback is not announced")
+	}
 
+	node.rollback = nil
+	node.rollbackAnnounced = true
+
+	return nil
+}
+
+// clearRollback removes the record of an announced rollback, once the block
+// replacing the abandoned ones is stored
+func (node *Node) clearRollback() {
+	if !node.rollbackAnnounced {
+		return
+	}
+	node.rollbackAnnounced = false
+
+	if err := removeRollback(node.store.Dir()); err != nil {
+		logrus.WithError(err).Warn("cant remove rollback record")
+	}
+}
+
+func (node *Node) writeBlock(block *types.Block) error {
 	if err := node.store.WriteBlock(block); err != nil {
 		return err
 	}
 
+	if !node.batching {
+		if err := node.writeState(block); err != nil {
+			return err
+		}
+		node.clearRollback()
+	}
+
+	if err := node.pruneBlocks(block.Height); err != nil {
+		return err
+	}
+
+	node.feed.Publish(block)
+	return nil
+}
+
+func (node *Node) writeState(block *types.Block) error {
+	state := node.engine.State(block.Hash)
+	if state == nil {
+		return fmt.Errorf("no account state for block %s", block.Hash)
+	}
+
+	return node.store.WriteState(state)
+}
+
+func (node *Node) beginBatch() {
+	node.store.BeginBatch()
+	node.batching = true
+}
+
+// endBatch makes the blocks of the batch durable, then writes the account state
+// of the tip once for all of them
+func (node *Node) endBatch() error {
+	if !node.batching {
+		return nil
+	}
+	node.batching = false
+
+	if err := node.store.EndBatch(); err != nil {
+		return err
+	}
+	if node.tip == nil {
+		return nil
+	}
+
+	if err := node.writeState(node.tip); err != nil {
+		return err
+	}
+	node.clearRollback()
+
 	return nil
 }
+
+// pruneBlocks removes blocks past the retention from the store in batches. Blocks
+// above the LIB may still be replaced by a reorg, so they are kept regardless.
+func (node *Node) pruneBlocks(tip uint64) error {
+	cutoff := RetentionCutoff(tip, node.store.LibHeight(), node.retainBlocks)
+	if cutoff < node.store.StartHeight()+pruneBatchSize {
+		return nil
+	}
+
+	logrus.WithField("height", cutoff).Debug("pruning blocks")
+	return node.store.Prune(cutoff)
+}
+
+// pruneSideBlocks drops competing blocks that are too old to ever win. They are
+// kept as long as the engine keeps their state, which covers the fork depth.
+func (node *Node) pruneSideBlocks() {
+	for hash, block := range node.sideBlocks {
+		if block.Height+uint64(node.engine.statesLimit) < node.tip.Height {
+			delete(node.sideBlocks, hash)
+		}
+	}
+}
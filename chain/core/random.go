@@ -0,0 +1,37 @@
+package core
+
+// chainRand is a random number generator that only depends on the seed and the
+// values it is created with, like the block height. The chain then comes out the
+// same whether or not the node was restarted while producing it, as nothing of
+// the generator has to be kept across runs.
+type chainRand struct {
+	state uint64
+}
+
+func newChainRand(seed int64, values ...uint64) *chainRand {
+	r := &chainRand{state: uint64(seed)}
+	for _, value := range values {
+		r.state = r.Uint64() ^ value
+	}
+	return r
+}
+
+// Uint64 returns the next value of the splitmix64 sequence
+func (r *chainRand) Uint64() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Int63n returns a value in [0, n), n must be positive
+func (r *chainRand) Int63n(n int64) int64 {
+	return int64(r.Uint64() % uint64(n))
+}
+
+// Intn returns a value in [0, n), n must be positive
+func (r *chainRand) Intn(n int) int {
+	return int(r.Int63n(int64(n)))
+}
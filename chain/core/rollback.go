@@ -0,0 +1,162 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const rollbackFilename = "rollback.json"
+
+// Rollback records a rewind of the chain, which the node announces in the
+// DeepMind output before it produces the replacement blocks
+type Rollback struct {
+	// Block the chain was rewound to
+	Height uint64 `json:"height"`
+	Hash   string `json:"hash"`
+
+	// Tip before the rewind, and the first abandoned block
+	FromHeight    uint64 `json:"from_height"`
+	AbandonedHash string `json:"abandoned_hash"`
+}
+
+// RollbackStore removes all blocks above given height and rewinds the account
+// state to that height. The state is rebuilt from the first stored block, so
+// the store must hold the history from the genesis on. Blocks below the LIB are
+// only removed when forced.
+func RollbackStore(store Store, height uint64, force bool) (*Rollback, error) {
+	tip := store.TipHeight()
+	if height >= tip {
+		return nil, fmt.Errorf("target height %d is not below the tip %d", height, tip)
+	}
+	if height < store.StartHeight() {
+		return nil, fmt.Errorf("target height %d is below the store start height %d", height, store.StartHeight())
+	}
+	if pruned := store.PrunedHeight(); pruned > 0 {
+		return nil, fmt.Errorf("cant rebuild the account state, blocks up to %d are pruned", pruned)
+	}
+	if lib := store.LibHeight(); height < lib && !force {
+		return nil, fmt.Errorf("target height %d is below the last irreversible block %d", height, lib)
+	}
+
+	target, err := store.ReadBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	abandoned, err := store.ReadBlock(height + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := ReplayState(store, height)
+	if err != nil {
+		return nil, err
+	}
+
+	rollback := &Rollback{
+		Height:        target.Height,
+		Hash:          target.Hash,
+		FromHeight:    tip,
+		AbandonedHash: abandoned.Hash,
+	}
+
+	// The state goes before the blocks are removed, the store drops blocks above
+	// the state when the node crashes in between
+	if err := writeRollback(store.Dir(), rollback); err != nil {
+		return nil, err
+	}
+	if err := store.WriteState(state); err != nil {
+		return nil, err
+	}
+	if err := store.Truncate(height); err != nil {
+		return nil, err
+	}
+
+	return rollback, nil
+}
+
+// ReplayState applies all stored blocks up to given height on the genesis state
+func ReplayState(store Store, height uint64) (*State, error) {
+	state, _, err := initialState(store)
+	if err != nil {
+		return nil, err
+	}
+
+	lastReport := time.Now()
+
+	for h := store.StartHeight(); h <= height; h++ {
+		block, err := store.ReadBlock(h)
+		if err != nil {
+			return nil, fmt.Errorf("cant read block %d: %v", h, err)
+		}
+
+		if state, err = replayBlock(state, block); err != nil {
+			return nil, err
+		}
+
+		if time.Since(lastReport) >= progressReportInterval {
+			lastReport = time.Now()
+			logrus.WithField("height", h).WithField("target", height).Info("account state replay progress")
+		}
+	}
+
+	return state, nil
+}
+
+// loadRollback returns the pending rollback of the store, if it still matches the tip
+func loadRollback(store Store) (*Rollback, error) {
+	path := filepath.Join(store.Dir(), rollbackFilename)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rollback := &Rollback{}
+	if err := json.Unmarshal(data, rollback); err != nil {
+		logrus.WithField("path", path).WithError(err).Warn("discarding unreadable rollback record")
+		return nil, removeRollback(store.Dir())
+	}
+
+	// A rollback interrupted before the blocks were removed never happened
+	if store.TipHeight() != rollback.Height {
+		logrus.WithField("height", rollback.Height).Warn("discarding rollback record that does not match the tip")
+		return nil, removeRollback(store.Dir())
+	}
+
+	tip, err := store.ReadBlock(rollback.Height)
+	if err != nil {
+		return nil, err
+	}
+	if tip.Hash != rollback.Hash {
+		logrus.WithField("height", rollback.Height).Warn("discarding rollback record that does not match the tip")
+		return nil, removeRollback(store.Dir())
+	}
+
+	return rollback, nil
+}
+
+func writeRollback(dir string, rollback *Rollback) error {
+	data, err := json.MarshalIndent(rollback, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, rollbackFilename), data, 0644)
+}
+
+func removeRollback(dir string) error {
+	err := os.Remove(filepath.Join(dir, rollbackFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
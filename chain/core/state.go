@@ -0,0 +1,166 @@
+package core
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+var (
+	// GenesisAllocations defines the initial account balances when the chain
+	// starts from the genesis height.
+	GenesisAllocations = map[string]*big.Int{
+		"0xDEADBEEF": big.NewInt(1000000000000000),
+	}
+
+	ErrInsufficientFunds = errors.New("insufficient funds for amount and fee")
+)
+
+type Account struct {
+	Balance *big.Int `json:"balance"`
+	Nonce   uint64   `json:"nonce"`
+}
+
+// State holds all account balances and nonces after the block with given height and hash
+type State struct {
+	Height   uint64              `json:"height"`
+	Hash     string              `json:"hash"`
+	Burned   *big.Int            `json:"burned"`
+	Accounts map[string]*Account `json:"accounts"`
+
+	// Balance changes made by each transaction of the block, only kept in memory
+	BalanceChanges [][]types.BalanceChange `json:"-"`
+}
+
+func NewState() *State {
+	return &State{
+		Burned:   big.NewInt(0),
+		Accounts: map[string]*Account{},
+	}
+}
+
+// NewGenesisState returns a state with all genesis allocations credited
+func NewGenesisState(allocations map[string]*big.Int) *State {
+	state := NewState()
+
+	for addr, balance := range allocations {
+		state.account(addr).Balance.Set(balance)
+	}
+
+	return state
+}
+
+// Balance returns the current balance of the account
+func (s *State) Balance(addr string) *big.Int {
+	if acc, ok := s.Accounts[addr]; ok {
+		return new(big.Int).Set(acc.Balance)
+	}
+	return big.NewInt(0)
+}
+
+// Nonce returns the number of transactions sent by the account
+func (s *State) Nonce(addr string) uint64 {
+	if acc, ok := s.Accounts[addr]; ok {
+		return acc.Nonce
+	}
+	return 0
+}
+
+// Addresses returns a sorted list of all known accounts
+func (s *State) Addresses() []string {
+	addrs := make([]string, 0, len(s.Accounts))
+	for addr := range s.Accounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// ApplyTransaction transfers the amount from sender to receiver and burns the fee.
+// When the sender cannot afford both the amount and the fee, the transaction is
+// marked as failed and only the fee is burned, if the sender can cover it.
+func (s *State) ApplyTransaction(tx *types.Transaction) error {
+	_, err := s.TraceTransaction(tx)
+	return err
+}
+
+// TraceTransaction applies the transaction like ApplyTransaction, and returns the
+// balance changes it made in order.
+func (s *State) TraceTransaction(tx *types.Transaction) ([]types.BalanceChange, error) {
+	changes := []types.BalanceChange{}
+
+	sender := s.account(tx.Sender)
+	sender.Nonce++
+
+	cost := new(big.Int).Add(tx.Amount, tx.Fee)
+	if sender.Balance.Cmp(cost) < 0 {
+		tx.Success = false
+
+		if sender.Balance.Cmp(tx.Fee) >= 0 {
+			changes = s.changeBalance(changes, tx.Sender, new(big.Int).Neg(tx.Fee), types.BalanceChangeReasonFee)
+			s.Burned.Add(s.Burned, tx.Fee)
+		}
+
+		return changes, ErrInsufficientFunds
+	}
+
+	// The receiver account exists from now on, even when nothing is transferred
+	s.account(tx.Receiver)
+
+	changes = s.changeBalance(changes, tx.Sender, new(big.Int).Neg(tx.Fee), types.BalanceChangeReasonFee)
+	changes = s.changeBalance(changes, tx.Sender, new(big.Int).Neg(tx.Amount), types.BalanceChangeReasonTransferSend)
+	changes = s.changeBalance(changes, tx.Receiver, tx.Amount, types.BalanceChangeReasonTransferReceive)
+	s.Burned.Add(s.Burned, tx.Fee)
+
+	tx.Success = true
+	return changes, nil
+}
+
+// changeBalance adds the delta to the account balance and records the change.
+// Zero deltas leave the balance untouched and are not recorded.
+func (s *State) changeBalance(changes []types.BalanceChange, addr string, delta *big.Int, reason string) []types.BalanceChange {
+	if delta.Sign() == 0 {
+		return changes
+	}
+
+	acc := s.account(addr)
+	oldValue := new(big.Int).Set(acc.Balance)
+	acc.Balance.Add(acc.Balance, delta)
+
+	return append(changes, types.BalanceChange{
+		Address:  addr,
+		OldValue: oldValue,
+		NewValue: new(big.Int).Set(acc.Balance),
+		Reason:   reason,
+	})
+}
+
+// Clone returns a deep copy of the state
+func (s *State) Clone() *State {
+	clone := &State{
+		Height:   s.Height,
+		Hash:     s.Hash,
+		Burned:   new(big.Int).Set(s.Burned),
+		Accounts: make(map[string]*Account, len(s.Accounts)),
+	}
+
+	for addr, acc := range s.Accounts {
+		clone.Accounts[addr] = &Account{
+			Balance: new(big.Int).Set(acc.Balance),
+			Nonce:   acc.Nonce,
+		}
+	}
+
+	return clone
+}
+
+func (s *State) account(addr string) *Account {
+	acc, ok := s.Accounts[addr]
+	if !ok {
+		acc = &Account{Balance: big.NewInt(0)}
+		s.Accounts[addr] = acc
+	}
+	return acc
+}
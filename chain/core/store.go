@@ -2,6 +2,7 @@ package core
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -11,103 +12,526 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-type Store struct {
-	rootDir   string
-	blocksDir string
-	metaPath  string
+const (
+	// One pretty-printed JSON file per block height
+	StoreBackendJSON = "json"
 
-	meta struct {
-		StartHeight uint64 `json:"start_height"`
-		TipHeight   uint64 `json:"tip_height"`
+	// Blocks appended to fixed-size segment files with an offset index
+	StoreBackendSegments = "segments"
+)
+
+const (
+	// Directory the migrated blocks are written to, and the file holding the
+	// target backend once they are all written
+	migrateDirname        = "migrate.tmp"
+	migrateMarkerFilename = "migrate.target"
+)
+
+var (
+	ErrBlockNotFound       = errors.New("block not found")
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrStoreReadOnly       = errors.New("store is opened read-only")
+	ErrBlockPruned         = errors.New("block is pruned")
+)
+
+// PrunedError is returned for blocks removed from the store by pruning
+type PrunedError struct {
+	Height      uint64
+	StartHeight uint64
+}
+
+func (e *PrunedError) Error() string {
+	return fmt.Sprintf("block %d is pruned, the store starts at height %d", e.Height, e.StartHeight)
+}
+
+func (e *PrunedError) Is(target error) bool {
+	return target == ErrBlockPruned
+}
+
+// TransactionRecord is a transaction along with its location in the chain
+type TransactionRecord struct {
+	BlockHeight uint64            `json:"block_height"`
+	BlockHash   string            `json:"block_hash"`
+	Index       int               `json:"index"`
+	Transaction types.Transaction `json:"transaction"`
+}
+
+// Store persists the canonical chain and the account state at its tip.
+// Writing a block at or below the tip height replaces the stored blocks from
+// that height on, which is how reorgs are applied.
+type Store interface {
+	Initialize() error
+	Close() error
+
+	// Dir returns the root directory of the store
+	Dir() string
+
+	StartHeight() uint64
+	TipHeight() uint64
+	LibHeight() uint64
+
+	// PrunedHeight returns the last height removed by pruning, reading it or any
+	// height below fails with ErrBlockPruned
+	PrunedHeight() uint64
+
+	WriteBlock(block *types.Block) error
+	ReadBlock(height uint64) (*types.Block, error)
+
+	// BeginBatch defers syncing written blocks until EndBatch, which makes all of
+	// them durable at once. Blocks of an unfinished batch may be lost in a crash,
+	// the repair on the next start drops whatever did not make it to disk.
+	BeginBatch()
+	EndBatch() error
+
+	// Truncate removes all blocks above given height
+	Truncate(height uint64) error
+
+	// Prune removes blocks below given height. Backends may keep some of them
+	// when they can only remove blocks in larger units.
+	Prune(height uint64) error
+
+	ReadBlockByHash(hash string) (*types.Block, error)
+	ReadTransaction(hash string) (*TransactionRecord, error)
+
+	// ReadAddressTransactions returns transactions sent or received by the address
+	// below given height (0 for the tip), the most recent first
+	ReadAddressTransactions(address string, before uint64, limit int) ([]TransactionRecord, error)
+
+	WriteState(state *State) error
+	ReadState() (*State, error)
+}
+
+// NewStore returns a store with given backend. An existing store directory must
+// use the same backend, otherwise it has to be migrated first.
+func NewStore(backend string, rootDir string) (Store, error) {
+	if err := resumeMigration(rootDir); err != nil {
+		return nil, err
+	}
+
+	existing, err := DetectStoreBackend(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != "" && existing != backend {
+		return nil, fmt.Errorf("store directory %s uses the %s backend, migrate it with the migrate command", rootDir, existing)
+	}
+
+	store, err := newStoreBackend(backend, rootDir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewIndexedStore(store), nil
+}
+
+// OpenStoreReadOnly opens the store directory as it is on disk, without repairing
+// damage left by an unclean shutdown, so it can be inspected. The store must be
+// initialized before use and rejects all writes.
+func OpenStoreReadOnly(rootDir string) (Store, error) {
+	backend, err := DetectStoreBackend(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	if backend == "" {
+		return nil, fmt.Errorf("store directory %s has no data", rootDir)
 	}
+
+	return newStoreBackend(backend, rootDir, true)
 }
 
-func NewStore(rootDir string) Store {
-	return Store{
-		rootDir:   rootDir,
-		blocksDir: filepath.Join(rootDir, "blocks"),
-		metaPath:  filepath.Join(rootDir, "meta.json"),
+// DetectStoreBackend returns the backend of existing data in the store directory,
+// or an empty string when there is no data yet.
+func DetectStoreBackend(rootDir string) (string, error) {
+	if exists(filepath.Join(rootDir, migrateMarkerFilename)) {
+		return "", fmt.Errorf("store directory %s has an interrupted migration, open it with the start or migrate command to complete it", rootDir)
+	}
+
+	found := []string{}
+
+	if exists(filepath.Join(rootDir, jsonStoreMetaFilename)) {
+		found = append(found, StoreBackendJSON)
+	}
+	if exists(filepath.Join(rootDir, segmentsDirname)) {
+		found = append(found, StoreBackendSegments)
+	}
+
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("store directory %s contains data of multiple backends: %v", rootDir, found)
 	}
 }
 
-func (store *Store) Initialize() error {
-	logrus.WithField("dir", store.rootDir).Debug("creating store root directory")
-	if err := os.MkdirAll(store.rootDir, 0700); err != nil {
+// MigrateStore copies all blocks of the store directory into the given backend
+// and removes the data of the previous one. The account state and producer key
+// are shared by all backends and stay in place.
+func MigrateStore(rootDir string, backend string) error {
+	if err := resumeMigration(rootDir); err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(store.blocksDir, 0700); err != nil {
+	current, err := DetectStoreBackend(rootDir)
+	if err != nil {
 		return err
 	}
+	if current == "" {
+		return fmt.Errorf("store directory %s has no data", rootDir)
+	}
+	if current == backend {
+		return fmt.Errorf("store directory %s already uses the %s backend", rootDir, backend)
+	}
 
-	if err := store.readMeta(); err != nil {
+	src, err := newStoreBackend(current, rootDir, false)
+	if err != nil {
 		return err
 	}
+	if err := src.Initialize(); err != nil {
+		return err
+	}
+	defer src.Close()
 
-	return nil
-}
-
-func (store *Store) WriteBlock(block *types.Block) error {
-	store.meta.TipHeight = block.Height
-	if store.meta.StartHeight == 0 {
-		store.meta.StartHeight = block.Height
+	// The new backend is written next to the old one, and only moved in place
+	// once all blocks are copied.
+	tmpDir := filepath.Join(rootDir, migrateDirname)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
 	}
 
-	raw, err := store.encodeBlock(block)
+	dst, err := newStoreBackend(backend, tmpDir, false)
 	if err != nil {
 		return err
 	}
+	if err := dst.Initialize(); err != nil {
+		return err
+	}
+
+	logrus.
+		WithField("from", current).
+		WithField("to", backend).
+		WithField("start", src.StartHeight()).
+		WithField("tip", src.TipHeight()).
+		Info("migrating store")
+
+	for height := src.StartHeight(); height > 0 && height <= src.TipHeight(); height++ {
+		block, err := src.ReadBlock(height)
+		if err != nil {
+			dst.Close()
+			return fmt.Errorf("cant read block %d: %v", height, err)
+		}
+
+		if err := dst.WriteBlock(block); err != nil {
+			dst.Close()
+			return fmt.Errorf("cant write block %d: %v", height, err)
+		}
+	}
+
+	if pruned := src.PrunedHeight(); pruned > 0 {
+		if err := dst.Prune(pruned + 1); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// From here on the migration is completed by the next open when interrupted
+	if err := writeFileAtomic(filepath.Join(rootDir, migrateMarkerFilename), []byte(backend), 0644); err != nil {
+		return err
+	}
 
-	meta, err := json.MarshalIndent(store.meta, "", "  ")
+	return resumeMigration(rootDir)
+}
+
+// resumeMigration moves the migrated blocks in place and removes the data of the
+// previous backend, once all blocks were written. A migration interrupted before
+// has no marker and its partial copy is discarded by the next one.
+func resumeMigration(rootDir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(rootDir, migrateMarkerFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	if err := ioutil.WriteFile(store.blockFilename(block.Height), raw, 0655); err != nil {
+	backend := string(data)
+	if _, err := newStoreBackend(backend, rootDir, true); err != nil {
+		return fmt.Errorf("invalid migration marker: %w", err)
+	}
+
+	tmpDir := filepath.Join(rootDir, migrateDirname)
+
+	// Files already moved are no longer in the temporary directory
+	for _, name := range storeBackendFiles(backend) {
+		if !exists(filepath.Join(tmpDir, name)) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(tmpDir, name), filepath.Join(rootDir, name)); err != nil {
+			return err
+		}
+	}
+
+	for _, previous := range []string{StoreBackendJSON, StoreBackendSegments} {
+		if previous == backend {
+			continue
+		}
+		for _, name := range storeBackendFiles(previous) {
+			if err := os.RemoveAll(filepath.Join(rootDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+
+	logrus.WithField("backend", backend).Info("completed store migration")
+	return os.Remove(filepath.Join(rootDir, migrateMarkerFilename))
+}
+
+func newStoreBackend(backend string, rootDir string, readOnly bool) (Store, error) {
+	switch backend {
+	case StoreBackendJSON:
+		store := NewJSONStore(rootDir)
+		store.readOnly = readOnly
+		return store, nil
+	case StoreBackendSegments:
+		store := NewSegmentStore(rootDir, DefaultSegmentSize)
+		store.readOnly = readOnly
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unsupported store backend: %q", backend)
+	}
+}
+
+// storeBackendFiles returns the files and directories holding the backend blocks
+func storeBackendFiles(backend string) []string {
+	switch backend {
+	case StoreBackendJSON:
+		return []string{jsonStoreBlocksDirname, jsonStoreMetaFilename}
+	case StoreBackendSegments:
+		return []string{segmentsDirname}
+	default:
+		return nil
+	}
+}
+
+// RetentionCutoff returns the lowest height to keep with given number of retained
+// blocks, which is never above the LIB. Zero means nothing is pruned.
+func RetentionCutoff(tip uint64, lib uint64, retain uint64) uint64 {
+	if retain == 0 || tip < retain {
+		return 0
+	}
+
+	cutoff := tip - retain + 1
+	if cutoff > lib {
+		cutoff = lib
+	}
+
+	return cutoff
+}
+
+// scanBlockByHash walks the chain from the tip down for a block with given hash
+func scanBlockByHash(store Store, hash string) (*types.Block, error) {
+	for height := store.TipHeight(); height >= store.StartHeight() && height > 0; height-- {
+		block, err := store.ReadBlock(height)
+		if err != nil {
+			return nil, err
+		}
+
+		if block.Hash == hash {
+			return block, nil
+		}
+	}
+
+	return nil, ErrBlockNotFound
+}
+
+// scanTransaction walks the chain from the tip down for a transaction with given hash
+func scanTransaction(store Store, hash string) (*TransactionRecord, error) {
+	for height := store.TipHeight(); height >= store.StartHeight() && height > 0; height-- {
+		block, err := store.ReadBlock(height)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx, tx := range block.Transactions {
+			if tx.Hash == hash {
+				return &TransactionRecord{
+					BlockHeight: block.Height,
+					BlockHash:   block.Hash,
+					Index:       idx,
+					Transaction: tx,
+				}, nil
+			}
+		}
+	}
+
+	return nil, ErrTransactionNotFound
+}
+
+// scanAddressTransactions walks the chain from the tip down for transactions of the address
+func scanAddressTransactions(store Store, address string, before uint64, limit int) ([]TransactionRecord, error) {
+	records := []TransactionRecord{}
+
+	height := store.TipHeight()
+	if before > 0 && before <= height {
+		height = before - 1
+	}
+
+	for ; height >= store.StartHeight() && height > 0 && len(records) < limit; height-- {
+		block, err := store.ReadBlock(height)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx := len(block.Transactions) - 1; idx >= 0 && len(records) < limit; idx-- {
+			tx := block.Transactions[idx]
+			if tx.Sender != address && tx.Receiver != address {
+				continue
+			}
+
+			records = append(records, TransactionRecord{
+				BlockHeight: block.Height,
+				BlockHash:   block.Hash,
+				Index:       idx,
+				Transaction: tx,
+			})
+		}
+	}
+
+	return records, nil
+}
+
+func writeStateFile(path string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(store.metaPath, meta, 0655)
+	return writeFileAtomic(path, data, 0644)
 }
 
-func (store *Store) ReadBlock(height uint64) (*types.Block, error) {
-	block := &types.Block{}
+func readStateFile(path string) (*State, error) {
+	state := NewState()
 
-	data, err := ioutil.ReadFile(store.blockFilename(height))
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return block, json.Unmarshal(data, block)
+	return state, json.Unmarshal(data, state)
 }
 
-func (store *Store) blockFilename(height uint64) string {
-	return fmt.Sprintf("%s/%d.json", store.blocksDir, height)
+// storeRecovery reports the fixes applied while opening a store after a crash
+type storeRecovery struct {
+	dir   string
+	fixes int
 }
 
-func (store *Store) readMeta() error {
-	_, err := os.Stat(store.metaPath)
-	if err != nil {
-		logrus.WithField("path", store.metaPath).WithError(err).Debug("cant open meta file, creating")
+func (r *storeRecovery) fixed(format string, args ...interface{}) {
+	r.fixes++
+	logrus.WithField("dir", r.dir).Warnf("store repair: "+format, args...)
+}
+
+func (r *storeRecovery) report() {
+	if r.fixes > 0 {
+		logrus.WithField("dir", r.dir).WithField("fixes", r.fixes).Warn("store recovered from an unclean shutdown")
+	}
+}
+
+// reconcileStore makes the stored chain consistent with the account state.
+// Blocks above the LIB may be replaced by a reorg, so they must link to each
+// other, blocks written after the last stored state are dropped, since the
+// node produces them again, and a state left above a dropped tip is rebuilt.
+func reconcileStore(store Store, statePath string, recovery *storeRecovery) error {
+	start := store.StartHeight()
+	if lib := store.LibHeight(); lib > start {
+		start = lib
+	}
 
-		meta, err := json.MarshalIndent(store.meta, "", "  ")
+	for height := store.TipHeight(); height > start; height-- {
+		block, err := store.ReadBlock(height)
 		if err != nil {
 			return err
 		}
-
-		if err := ioutil.WriteFile(store.metaPath, meta, 0655); err != nil {
+		parent, err := store.ReadBlock(height - 1)
+		if err != nil {
 			return err
 		}
+
+		if block.PrevHash != parent.Hash {
+			recovery.fixed("block %d does not link to block %d, removing blocks above %d", height, height-1, height-1)
+			if err := store.Truncate(height - 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	tip := store.TipHeight()
+	if tip == 0 || !exists(statePath) {
+		return nil
 	}
 
-	data, err := ioutil.ReadFile(store.metaPath)
+	state, err := readStateFile(statePath)
+	if err != nil {
+		// A torn state file can't be recovered from the blocks, the node reports it
+		logrus.WithField("path", statePath).WithError(err).Error("cant read account state")
+		return nil
+	}
+
+	if state.Height > tip {
+		return rewindState(store, statePath, state, recovery)
+	}
+	if state.Height == tip || state.Height < store.StartHeight() {
+		return nil
+	}
+
+	block, err := store.ReadBlock(state.Height)
 	if err != nil {
 		return err
 	}
+	if state.Hash != "" && state.Hash != block.Hash {
+		return nil
+	}
+
+	recovery.fixed("account state is at height %d, removing blocks above it", state.Height)
+	return store.Truncate(state.Height)
+}
+
+// rewindState rebuilds the account state at the tip after the repair dropped
+// the blocks it was written for
+func rewindState(store Store, statePath string, state *State, recovery *storeRecovery) error {
+	tip := store.TipHeight()
+
+	// Without the history from the genesis on the state can't be replayed, the
+	// node reports the mismatch
+	if pruned := store.PrunedHeight(); pruned > 0 {
+		logrus.
+			WithField("state", state.Height).
+			WithField("tip", tip).
+			WithField("pruned", pruned).
+			Error("account state is above the tip and cant be rebuilt from pruned blocks")
+		return nil
+	}
+
+	recovery.fixed("account state is at height %d above the tip %d, rebuilding it from the blocks", state.Height, tip)
 
-	return json.Unmarshal(data, &store.meta)
+	rewound, err := ReplayState(store, tip)
+	if err != nil {
+		return fmt.Errorf("cant rebuild account state at height %d: %v", tip, err)
+	}
+	return writeStateFile(statePath, rewound)
 }
 
-func (store *Store) encodeBlock(block *types.Block) ([]byte, error) {
-	return json.MarshalIndent(block, "", "  ")
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// IndexedStore keeps the index of a store backend up to date with every block
+// written or removed, and answers hash and address lookups from it.
+type IndexedStore struct {
+	Store
+	index *Index
+
+	// Blocks written since BeginBatch, indexed in one transaction by EndBatch
+	batch   bool
+	pending []*types.Block
+}
+
+func NewIndexedStore(store Store) *IndexedStore {
+	return &IndexedStore{Store: store}
+}
+
+// Initialize opens the store and catches the index up with the stored blocks,
+// which indexes existing stores on the first start as well.
+func (store *IndexedStore) Initialize() error {
+	if err := store.Store.Initialize(); err != nil {
+		return err
+	}
+
+	index, err := OpenIndex(store.Dir())
+	if err != nil {
+		return err
+	}
+	store.index = index
+
+	return index.Sync(store.Store)
+}
+
+func (store *IndexedStore) Close() error {
+	if store.index != nil {
+		if err := store.index.Close(); err != nil {
+			store.Store.Close()
+			return err
+		}
+	}
+
+	return store.Store.Close()
+}
+
+// WriteBlock writes the block and indexes it. The index is brought back in line
+// on the next start if the node crashes in between.
+func (store *IndexedStore) WriteBlock(block *types.Block) error {
+	if err := store.Store.WriteBlock(block); err != nil {
+		return err
+	}
+
+	if store.batch {
+		store.pending = append(store.pending, block)
+		return nil
+	}
+	return store.index.Add(block)
+}
+
+func (store *IndexedStore) BeginBatch() {
+	store.Store.BeginBatch()
+	store.batch = true
+}
+
+func (store *IndexedStore) EndBatch() error {
+	store.batch = false
+	if err := store.Store.EndBatch(); err != nil {
+		return err
+	}
+
+	return store.indexPending()
+}
+
+// indexPending adds the blocks of the batch to the index
+func (store *IndexedStore) indexPending() error {
+	if len(store.pending) == 0 {
+		return nil
+	}
+
+	if err := store.index.Add(store.pending...); err != nil {
+		return err
+	}
+	store.pending = nil
+
+	return nil
+}
+
+func (store *IndexedStore) Truncate(height uint64) error {
+	if err := store.indexPending(); err != nil {
+		return err
+	}
+	if err := store.Store.Truncate(height); err != nil {
+		return err
+	}
+
+	return store.index.Truncate(height)
+}
+
+func (store *IndexedStore) Prune(height uint64) error {
+	if err := store.indexPending(); err != nil {
+		return err
+	}
+	if err := store.Store.Prune(height); err != nil {
+		return err
+	}
+
+	return store.index.Prune(store.StartHeight())
+}
+
+func (store *IndexedStore) ReadBlockByHash(hash string) (*types.Block, error) {
+	height, found, err := store.index.BlockHeight(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrBlockNotFound
+	}
+
+	return store.ReadBlock(height)
+}
+
+func (store *IndexedStore) ReadTransaction(hash string) (*TransactionRecord, error) {
+	loc, err := store.index.Transaction(hash)
+	if err != nil {
+		return nil, err
+	}
+	if loc == nil {
+		return nil, ErrTransactionNotFound
+	}
+
+	return store.readTransactionAt(*loc)
+}
+
+func (store *IndexedStore) ReadAddressTransactions(address string, before uint64, limit int) ([]TransactionRecord, error) {
+	locs, err := store.index.AddressTransactions(address, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []TransactionRecord{}
+	for _, loc := range locs {
+		record, err := store.readTransactionAt(loc)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+
+	return records, nil
+}
+
+func (store *IndexedStore) readTransactionAt(loc TxLocation) (*TransactionRecord, error) {
+	block, err := store.ReadBlock(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	if loc.Index >= len(block.Transactions) {
+		return nil, ErrTransactionNotFound
+	}
+
+	return &TransactionRecord{
+		BlockHeight: block.Height,
+		BlockHash:   block.Hash,
+		Index:       loc.Index,
+		Transaction: block.Transactions[loc.Index],
+	}, nil
+}
@@ -0,0 +1,557 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	jsonStoreBlocksDirname = "blocks"
+	jsonStoreMetaFilename  = "meta.json"
+	stateFilename          = "state.json"
+)
+
+// JSONStore keeps every block in a separate pretty-printed JSON file, which is
+// easy to inspect but does not scale to long chains.
+type JSONStore struct {
+	// Guards the files and meta, so blocks can be read while the node is running
+	lock *sync.RWMutex
+
+	// Read-only stores are opened as they are, without any repair
+	readOnly bool
+
+	rootDir   string
+	blocksDir string
+	metaPath  string
+	statePath string
+
+	meta struct {
+		StartHeight  uint64 `json:"start_height"`
+		TipHeight    uint64 `json:"tip_height"`
+		LibHeight    uint64 `json:"lib_height"`
+		PrunedHeight uint64 `json:"pruned_height"`
+	}
+
+	// Blocks written since BeginBatch, synced together with the meta by EndBatch
+	batch    bool
+	unsynced []uint64
+}
+
+func NewJSONStore(rootDir string) *JSONStore {
+	return &JSONStore{
+		lock:      &sync.RWMutex{},
+		rootDir:   rootDir,
+		blocksDir: filepath.Join(rootDir, jsonStoreBlocksDirname),
+		metaPath:  filepath.Join(rootDir, jsonStoreMetaFilename),
+		statePath: filepath.Join(rootDir, stateFilename),
+	}
+}
+
+func (store *JSONStore) Initialize() error {
+	if store.readOnly {
+		return store.load()
+	}
+
+	logrus.WithField("dir", store.rootDir).Debug("creating store root directory")
+	if err := os.MkdirAll(store.rootDir, 0700); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(store.blocksDir, 0700); err != nil {
+		return err
+	}
+
+	// Writes are atomic, but a crash may still leave temporary files, a tip
+	// ahead of the block files, or blocks written after the last meta update.
+	recovery := &storeRecovery{dir: store.rootDir}
+
+	for _, dir := range []string{store.rootDir, store.blocksDir} {
+		removed, err := removeTmpFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, path := range removed {
+			recovery.fixed("removed unfinished write %s", path)
+		}
+	}
+
+	if err := store.readMeta(recovery); err != nil {
+		return err
+	}
+
+	if err := store.repair(recovery); err != nil {
+		return err
+	}
+
+	if err := reconcileStore(store, store.statePath, recovery); err != nil {
+		return err
+	}
+
+	recovery.report()
+	return nil
+}
+
+// load reads the meta of a read-only store. Without a readable meta the heights
+// span all block files, gaps included.
+func (store *JSONStore) load() error {
+	data, err := ioutil.ReadFile(store.metaPath)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &store.meta)
+	if err == nil {
+		return nil
+	}
+
+	logrus.WithField("path", store.metaPath).WithError(err).Warn("meta file is corrupted, using block files")
+
+	heights, err := store.listBlockFiles()
+	if err != nil || len(heights) == 0 {
+		return err
+	}
+
+	store.meta.StartHeight = heights[0]
+	store.meta.TipHeight = heights[len(heights)-1]
+
+	if block, err := store.readBlock(store.meta.TipHeight); err == nil {
+		store.meta.LibHeight = block.LibNum
+	}
+
+	return nil
+}
+
+func (store *JSONStore) Close() error {
+	return nil
+}
+
+func (store *JSONStore) Dir() string {
+	return store.rootDir
+}
+
+func (store *JSONStore) StartHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.meta.StartHeight
+}
+
+func (store *JSONStore) TipHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.meta.TipHeight
+}
+
+func (store *JSONStore) LibHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.meta.LibHeight
+}
+
+func (store *JSONStore) PrunedHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.meta.PrunedHeight
+}
+
+// WriteBlock stores the block after the tip. A block at or below the tip height
+// replaces the stored blocks from its height on.
+func (store *JSONStore) WriteBlock(block *types.Block) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+
+	raw, err := store.encodeBlock(block)
+	if err != nil {
+		return err
+	}
+
+	// Replaced blocks are removed first, so none of them is left above the new tip
+	if store.meta.TipHeight > 0 && block.Height <= store.meta.TipHeight {
+		if err := store.truncate(block.Height - 1); err != nil {
+			return err
+		}
+	}
+	if store.meta.TipHeight > 0 && block.Height != store.meta.TipHeight+1 {
+		return fmt.Errorf("block %d does not follow the tip %d", block.Height, store.meta.TipHeight)
+	}
+
+	if store.batch {
+		if err := replaceFile(store.blockFilename(block.Height), raw, 0644, false); err != nil {
+			return err
+		}
+		store.unsynced = append(store.unsynced, block.Height)
+		store.advanceMeta(block)
+		return nil
+	}
+
+	// The block goes first, so the meta never points to a missing block
+	if err := writeFileAtomic(store.blockFilename(block.Height), raw, 0644); err != nil {
+		return err
+	}
+
+	previous := store.meta
+	store.advanceMeta(block)
+
+	if err := store.writeMeta(); err != nil {
+		store.meta = previous
+		return err
+	}
+	return nil
+}
+
+// advanceMeta moves the tip to a written block
+func (store *JSONStore) advanceMeta(block *types.Block) {
+	store.meta.TipHeight = block.Height
+	store.meta.LibHeight = block.LibNum
+	if store.meta.StartHeight == 0 {
+		store.meta.StartHeight = block.Height
+	}
+}
+
+func (store *JSONStore) BeginBatch() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.batch = !store.readOnly
+}
+
+func (store *JSONStore) EndBatch() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.batch = false
+	return store.syncBatch()
+}
+
+// syncBatch syncs the blocks written in the batch, then moves the meta to them
+func (store *JSONStore) syncBatch() error {
+	if len(store.unsynced) == 0 {
+		return nil
+	}
+
+	for _, height := range store.unsynced {
+		if err := syncFile(store.blockFilename(height)); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(store.blocksDir); err != nil {
+		return err
+	}
+	store.unsynced = nil
+
+	return store.writeMeta()
+}
+
+func (store *JSONStore) ReadBlock(height uint64) (*types.Block, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.readBlock(height)
+}
+
+// Truncate removes all blocks above given height
+func (store *JSONStore) Truncate(height uint64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+
+	return store.truncate(height)
+}
+
+func (store *JSONStore) truncate(height uint64) error {
+	if err := store.syncBatch(); err != nil {
+		return err
+	}
+
+	tip := store.meta.TipHeight
+
+	if height < store.meta.StartHeight {
+		store.meta.StartHeight = 0
+		store.meta.TipHeight = 0
+		store.meta.LibHeight = 0
+	} else if height < tip {
+		block, err := store.readBlock(height)
+		if err != nil {
+			return err
+		}
+
+		store.meta.TipHeight = height
+		store.meta.LibHeight = block.LibNum
+	}
+
+	// Meta goes first, so a crash leaves orphan files instead of a tip without blocks
+	if err := store.writeMeta(); err != nil {
+		return err
+	}
+
+	for h := height + 1; h <= tip; h++ {
+		if err := os.Remove(store.blockFilename(h)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return syncDir(store.blocksDir)
+}
+
+// Prune removes block files below given height, the meta goes first so a crash
+// leaves orphan files that are removed on the next start
+func (store *JSONStore) Prune(height uint64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+	if height > store.meta.TipHeight {
+		return fmt.Errorf("cant prune blocks above the tip %d", store.meta.TipHeight)
+	}
+
+	if height == 0 || height <= store.meta.PrunedHeight+1 {
+		return nil
+	}
+
+	if err := store.syncBatch(); err != nil {
+		return err
+	}
+
+	start := store.meta.StartHeight
+	pruned := height - 1
+
+	store.meta.PrunedHeight = pruned
+	if pruned >= start {
+		store.meta.StartHeight = pruned + 1
+	}
+
+	if err := store.writeMeta(); err != nil {
+		return err
+	}
+
+	for h := start; h <= pruned; h++ {
+		if err := os.Remove(store.blockFilename(h)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return syncDir(store.blocksDir)
+}
+
+func (store *JSONStore) readBlock(height uint64) (*types.Block, error) {
+	if height <= store.meta.PrunedHeight {
+		return nil, &PrunedError{Height: height, StartHeight: store.meta.StartHeight}
+	}
+
+	block := &types.Block{}
+
+	data, err := ioutil.ReadFile(store.blockFilename(height))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBlockNotFound
+		}
+		return nil, err
+	}
+
+	return block, json.Unmarshal(data, block)
+}
+
+// ReadBlockByHash scans the chain from the tip down for a block with given hash
+func (store *JSONStore) ReadBlockByHash(hash string) (*types.Block, error) {
+	return scanBlockByHash(store, hash)
+}
+
+// ReadTransaction scans the chain from the tip down for a transaction with given hash
+func (store *JSONStore) ReadTransaction(hash string) (*TransactionRecord, error) {
+	return scanTransaction(store, hash)
+}
+
+// ReadAddressTransactions scans the chain from the tip down for transactions of the address
+func (store *JSONStore) ReadAddressTransactions(address string, before uint64, limit int) ([]TransactionRecord, error) {
+	return scanAddressTransactions(store, address, before, limit)
+}
+
+func (store *JSONStore) WriteState(state *State) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+
+	return writeStateFile(store.statePath, state)
+}
+
+func (store *JSONStore) ReadState() (*State, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return readStateFile(store.statePath)
+}
+
+func (store *JSONStore) blockFilename(height uint64) string {
+	return fmt.Sprintf("%s/%d.json", store.blocksDir, height)
+}
+
+func (store *JSONStore) readMeta(recovery *storeRecovery) error {
+	_, err := os.Stat(store.metaPath)
+	if err != nil {
+		logrus.WithField("path", store.metaPath).WithError(err).Debug("cant open meta file, creating")
+		return store.writeMeta()
+	}
+
+	data, err := ioutil.ReadFile(store.metaPath)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &store.meta); err != nil {
+		recovery.fixed("meta file is corrupted (%v), rebuilding it from block files", err)
+		return store.rebuildMeta()
+	}
+
+	return nil
+}
+
+func (store *JSONStore) writeMeta() error {
+	meta, err := json.MarshalIndent(store.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(store.metaPath, meta, 0644)
+}
+
+// rebuildMeta finds the longest run of block files from the lowest height
+func (store *JSONStore) rebuildMeta() error {
+	heights, err := store.listBlockFiles()
+	if err != nil {
+		return err
+	}
+
+	store.meta.StartHeight = 0
+	store.meta.TipHeight = 0
+	store.meta.LibHeight = 0
+
+	for _, height := range heights {
+		if store.meta.TipHeight > 0 && height != store.meta.TipHeight+1 {
+			break
+		}
+		if store.meta.StartHeight == 0 {
+			store.meta.StartHeight = height
+		}
+		store.meta.TipHeight = height
+	}
+
+	// Files past a gap and a corrupted tip are handled by the repair
+	if store.meta.TipHeight > 0 {
+		if block, err := store.readBlock(store.meta.TipHeight); err == nil {
+			store.meta.LibHeight = block.LibNum
+		}
+	}
+
+	return store.writeMeta()
+}
+
+// repair moves the tip down to the last readable block and removes block files
+// above the tip, left by writes that did not get to update the meta.
+func (store *JSONStore) repair(recovery *storeRecovery) error {
+	changed := false
+
+	for store.meta.TipHeight > 0 && store.meta.TipHeight >= store.meta.StartHeight {
+		tip := store.meta.TipHeight
+
+		block, err := store.readBlock(tip)
+		if err == nil {
+			store.meta.LibHeight = block.LibNum
+			break
+		}
+
+		recovery.fixed("block %d is missing or corrupted (%v), moving tip to %d", tip, err, tip-1)
+		if err := os.Remove(store.blockFilename(tip)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		store.meta.TipHeight--
+		changed = true
+	}
+
+	if store.meta.TipHeight < store.meta.StartHeight || store.meta.TipHeight == 0 {
+		if store.meta.TipHeight != 0 || store.meta.StartHeight != 0 {
+			changed = true
+		}
+
+		store.meta.StartHeight = 0
+		store.meta.TipHeight = 0
+		store.meta.LibHeight = 0
+	}
+
+	heights, err := store.listBlockFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, height := range heights {
+		if store.meta.TipHeight > 0 && height >= store.meta.StartHeight && height <= store.meta.TipHeight {
+			continue
+		}
+
+		recovery.fixed("removed orphan block file %s", store.blockFilename(height))
+		if err := os.Remove(store.blockFilename(height)); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return store.writeMeta()
+}
+
+// listBlockFiles returns heights of all block files in ascending order
+func (store *JSONStore) listBlockFiles() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(store.blocksDir)
+	if err != nil {
+		return nil, err
+	}
+
+	heights := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		height, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		heights = append(heights, height)
+	}
+
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights, nil
+}
+
+func (store *JSONStore) encodeBlock(block *types.Block) ([]byte, error) {
+	return json.MarshalIndent(block, "", "  ")
+}
@@ -0,0 +1,951 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	segmentsDirname      = "segments"
+	segmentsMetaFilename = "meta.json"
+
+	// Number of blocks in a single segment file
+	DefaultSegmentSize = 10000
+
+	// Every block record starts with the payload length and its CRC32-C checksum
+	segmentRecordHeaderSize = 8
+
+	// Every index entry is the offset of the block record in the segment file
+	segmentIndexEntrySize = 8
+)
+
+var (
+	ErrSegmentCorrupted = errors.New("segment record is corrupted")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SegmentStore appends blocks to segment files holding a fixed number of heights.
+// Each segment has an index file with the offset of every block in the segment,
+// so blocks are read with a single seek, and the tip is known from the index sizes
+// without rewriting any metadata on every block.
+//
+// Segment files are named after the first height they hold:
+//
+//	segments/0000000001.seg - block records
+//	segments/0000000001.idx - 8-byte record offsets, one per height
+type SegmentStore struct {
+	// Guards the files and heights, so blocks can be read while the node is running
+	lock *sync.RWMutex
+
+	// Read-only stores are opened as they are, without any repair
+	readOnly bool
+
+	rootDir   string
+	dir       string
+	statePath string
+
+	meta struct {
+		SegmentSize  uint64 `json:"segment_size"`
+		PrunedHeight uint64 `json:"pruned_height"`
+	}
+
+	startHeight uint64
+	tipHeight   uint64
+	libHeight   uint64
+
+	// Segment currently appended to
+	active *segment
+
+	// Appends since BeginBatch are synced by EndBatch
+	batch bool
+}
+
+type segment struct {
+	first uint64
+	data  *os.File
+	index *os.File
+
+	// Number of blocks in the segment and the size of the data file
+	count uint64
+	size  int64
+
+	// Records were appended without syncing the files
+	dirty bool
+}
+
+func NewSegmentStore(rootDir string, segmentSize uint64) *SegmentStore {
+	store := &SegmentStore{
+		lock:      &sync.RWMutex{},
+		rootDir:   rootDir,
+		dir:       filepath.Join(rootDir, segmentsDirname),
+		statePath: filepath.Join(rootDir, stateFilename),
+	}
+	store.meta.SegmentSize = segmentSize
+
+	return store
+}
+
+func (store *SegmentStore) Initialize() error {
+	if store.readOnly {
+		return store.load()
+	}
+
+	logrus.WithField("dir", store.dir).Debug("creating segments directory")
+	if err := os.MkdirAll(store.dir, 0700); err != nil {
+		return err
+	}
+
+	// Records are synced before their index entries, so a crash may only leave
+	// a partial record or index entry at the end of the last segment.
+	recovery := &storeRecovery{dir: store.rootDir}
+
+	for _, dir := range []string{store.rootDir, store.dir} {
+		removed, err := removeTmpFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, path := range removed {
+			recovery.fixed("removed unfinished write %s", path)
+		}
+	}
+
+	if err := store.readMeta(); err != nil {
+		return err
+	}
+
+	// Index files go first when segments are removed, the data left without one
+	// can't be reached
+	orphans, err := store.listOrphanData()
+	if err != nil {
+		return err
+	}
+	for _, path := range orphans {
+		recovery.fixed("removed segment data without index %s", path)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	firsts, err := store.listSegments()
+	if err != nil {
+		return err
+	}
+
+	// Pruning records the pruned height before it removes the segments
+	pruned := 0
+	for pruned < len(firsts) && firsts[pruned]+store.meta.SegmentSize-1 <= store.meta.PrunedHeight {
+		pruned++
+	}
+	if pruned > 0 {
+		recovery.fixed("removing %d segments below the pruned height %d", pruned, store.meta.PrunedHeight)
+		if err := store.pruneSegments(firsts[:pruned]); err != nil {
+			return err
+		}
+		firsts = firsts[pruned:]
+	}
+
+	// Segments must follow each other and all but the last one must be full,
+	// anything after a gap can't be reached.
+	for i, first := range firsts {
+		expected := firsts[0] + uint64(i)*store.meta.SegmentSize
+		if first != expected {
+			recovery.fixed("segment %d is missing, removing the following segments", expected)
+			if err := store.removeSegments(firsts[i:]); err != nil {
+				return err
+			}
+			firsts = firsts[:i]
+			break
+		}
+
+		if i == len(firsts)-1 {
+			break
+		}
+
+		seg, err := store.openSegment(first)
+		if err != nil {
+			return err
+		}
+		seg.close()
+
+		if seg.count != store.meta.SegmentSize {
+			recovery.fixed("segment %d has %d blocks instead of %d, removing the following segments", first, seg.count, store.meta.SegmentSize)
+			if err := store.removeSegments(firsts[i+1:]); err != nil {
+				return err
+			}
+			firsts = firsts[:i+1]
+			break
+		}
+	}
+
+	for len(firsts) > 0 {
+		seg, err := store.openSegment(firsts[len(firsts)-1])
+		if err != nil {
+			return err
+		}
+
+		if err := seg.repair(recovery); err != nil {
+			seg.close()
+			return err
+		}
+
+		if seg.count > 0 {
+			store.active = seg
+			break
+		}
+
+		// Segments are created along with their first block
+		recovery.fixed("removed empty segment %d", seg.first)
+		seg.close()
+		if err := store.removeSegments(firsts[len(firsts)-1:]); err != nil {
+			return err
+		}
+		firsts = firsts[:len(firsts)-1]
+	}
+
+	if store.active != nil {
+		store.startHeight = firsts[0]
+		store.tipHeight = store.active.first + store.active.count - 1
+
+		tip, err := store.readBlock(store.tipHeight)
+		if err != nil {
+			return fmt.Errorf("cant read tip block %d: %v", store.tipHeight, err)
+		}
+		store.libHeight = tip.LibNum
+	}
+
+	if err := reconcileStore(store, store.statePath, recovery); err != nil {
+		return err
+	}
+
+	recovery.report()
+	return nil
+}
+
+// load finds the heights of a read-only store. The tip is the last complete
+// index entry of the last segment, whether its record is intact or not.
+func (store *SegmentStore) load() error {
+	if err := store.readMeta(); err != nil {
+		return err
+	}
+
+	firsts, err := store.listSegments()
+	if err != nil || len(firsts) == 0 {
+		return err
+	}
+
+	seg, err := store.openSegment(firsts[len(firsts)-1])
+	if err != nil {
+		return err
+	}
+	store.active = seg
+
+	if seg.first+seg.count <= firsts[0] {
+		return nil
+	}
+
+	store.startHeight = firsts[0]
+	store.tipHeight = seg.first + seg.count - 1
+
+	if tip, err := store.readBlock(store.tipHeight); err == nil {
+		store.libHeight = tip.LibNum
+	}
+
+	return nil
+}
+
+func (store *SegmentStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.active == nil {
+		return nil
+	}
+
+	err := store.active.close()
+	store.active = nil
+
+	return err
+}
+
+func (store *SegmentStore) Dir() string {
+	return store.rootDir
+}
+
+func (store *SegmentStore) StartHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.startHeight
+}
+
+func (store *SegmentStore) TipHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.tipHeight
+}
+
+func (store *SegmentStore) LibHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.libHeight
+}
+
+func (store *SegmentStore) PrunedHeight() uint64 {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.meta.PrunedHeight
+}
+
+// WriteBlock appends the block after the tip. A block at or below the tip height
+// replaces the stored blocks from its height on.
+func (store *SegmentStore) WriteBlock(block *types.Block) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+
+	if store.tipHeight > 0 && block.Height <= store.tipHeight {
+		if err := store.truncate(block.Height - 1); err != nil {
+			return err
+		}
+	}
+
+	if store.tipHeight == 0 {
+		store.startHeight = block.Height
+	} else if block.Height != store.tipHeight+1 {
+		return fmt.Errorf("block %d does not follow the tip %d", block.Height, store.tipHeight)
+	}
+
+	first := store.segmentFirst(block.Height)
+	if store.active == nil || store.active.first != first {
+		if store.active != nil {
+			if err := store.active.close(); err != nil {
+				return err
+			}
+		}
+
+		seg, err := store.openSegment(first)
+		if err != nil {
+			return err
+		}
+		store.active = seg
+
+		if err := syncDir(store.dir); err != nil {
+			return err
+		}
+	}
+
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, segmentRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[segmentRecordHeaderSize:], payload)
+
+	if err := store.active.append(record, !store.batch); err != nil {
+		return err
+	}
+
+	store.tipHeight = block.Height
+	store.libHeight = block.LibNum
+
+	return nil
+}
+
+func (store *SegmentStore) BeginBatch() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.batch = !store.readOnly
+}
+
+// EndBatch syncs the active segment, segments left in the batch were synced
+// when they were closed
+func (store *SegmentStore) EndBatch() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.batch = false
+	if store.active == nil {
+		return nil
+	}
+
+	return store.active.sync()
+}
+
+func (store *SegmentStore) ReadBlock(height uint64) (*types.Block, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.readBlock(height)
+}
+
+// Truncate removes all blocks above given height
+func (store *SegmentStore) Truncate(height uint64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+
+	if height >= store.tipHeight {
+		return nil
+	}
+
+	return store.truncate(height)
+}
+
+// Prune removes all segments holding only blocks below given height. Segments
+// are never split, so up to a segment worth of blocks below the height is kept.
+func (store *SegmentStore) Prune(height uint64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+	if height > store.tipHeight {
+		return fmt.Errorf("cant prune blocks above the tip %d", store.tipHeight)
+	}
+	if height == 0 {
+		return nil
+	}
+
+	firsts, err := store.listSegments()
+	if err != nil {
+		return err
+	}
+
+	removed := []uint64{}
+	for _, first := range firsts {
+		if first+store.meta.SegmentSize-1 >= height {
+			break
+		}
+		removed = append(removed, first)
+	}
+
+	// Only heights that are no longer stored are reported as pruned
+	pruned := height - 1
+	if len(removed) < len(firsts) && firsts[len(removed)] <= pruned {
+		pruned = firsts[len(removed)] - 1
+	}
+	if pruned <= store.meta.PrunedHeight {
+		return nil
+	}
+
+	store.meta.PrunedHeight = pruned
+	if err := store.writeMeta(); err != nil {
+		return err
+	}
+
+	if err := store.pruneSegments(removed); err != nil {
+		return err
+	}
+
+	if len(removed) > 0 {
+		store.startHeight = firsts[len(removed)]
+	}
+
+	return nil
+}
+
+// ReadBlockByHash scans the chain from the tip down for a block with given hash
+func (store *SegmentStore) ReadBlockByHash(hash string) (*types.Block, error) {
+	return scanBlockByHash(store, hash)
+}
+
+// ReadTransaction scans the chain from the tip down for a transaction with given hash
+func (store *SegmentStore) ReadTransaction(hash string) (*TransactionRecord, error) {
+	return scanTransaction(store, hash)
+}
+
+// ReadAddressTransactions scans the chain from the tip down for transactions of the address
+func (store *SegmentStore) ReadAddressTransactions(address string, before uint64, limit int) ([]TransactionRecord, error) {
+	return scanAddressTransactions(store, address, before, limit)
+}
+
+func (store *SegmentStore) WriteState(state *State) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.readOnly {
+		return ErrStoreReadOnly
+	}
+
+	return writeStateFile(store.statePath, state)
+}
+
+func (store *SegmentStore) ReadState() (*State, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return readStateFile(store.statePath)
+}
+
+func (store *SegmentStore) readBlock(height uint64) (*types.Block, error) {
+	if height <= store.meta.PrunedHeight {
+		return nil, &PrunedError{Height: height, StartHeight: store.startHeight}
+	}
+	if store.tipHeight == 0 || height < store.startHeight || height > store.tipHeight {
+		return nil, ErrBlockNotFound
+	}
+
+	first := store.segmentFirst(height)
+
+	seg := store.active
+	if seg == nil || seg.first != first {
+		// Readers only hold the read lock, a missing segment must not be created
+		s, err := store.openSegmentFlag(first, os.O_RDONLY)
+		if os.IsNotExist(err) {
+			return nil, ErrBlockNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer s.close()
+		seg = s
+	}
+
+	payload, err := seg.read(height - first)
+	if err != nil {
+		return nil, fmt.Errorf("cant read block %d: %w", height, err)
+	}
+
+	block := &types.Block{}
+	return block, json.Unmarshal(payload, block)
+}
+
+// truncate removes all blocks above given height
+func (store *SegmentStore) truncate(height uint64) error {
+	if store.active != nil {
+		if err := store.active.close(); err != nil {
+			return err
+		}
+		store.active = nil
+	}
+
+	firsts, err := store.listSegments()
+	if err != nil {
+		return err
+	}
+
+	keepFirst := uint64(0)
+	if height >= store.startHeight {
+		keepFirst = store.segmentFirst(height)
+	}
+
+	removed := []uint64{}
+	for _, first := range firsts {
+		if keepFirst == 0 || first > keepFirst {
+			removed = append(removed, first)
+		}
+	}
+	if err := store.removeSegments(removed); err != nil {
+		return err
+	}
+
+	if keepFirst == 0 {
+		store.startHeight = 0
+		store.tipHeight = 0
+		store.libHeight = 0
+		return nil
+	}
+
+	seg, err := store.openSegment(keepFirst)
+	if err != nil {
+		return err
+	}
+	store.active = seg
+
+	if err := seg.truncate(height - keepFirst + 1); err != nil {
+		return err
+	}
+	store.tipHeight = height
+
+	tip, err := store.readBlock(height)
+	if err != nil {
+		return err
+	}
+	store.libHeight = tip.LibNum
+
+	return nil
+}
+
+// segmentFirst returns the first height of the segment holding given height
+func (store *SegmentStore) segmentFirst(height uint64) uint64 {
+	return height - (height-store.startHeight)%store.meta.SegmentSize
+}
+
+func (store *SegmentStore) segmentPath(first uint64, ext string) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%010d%s", first, ext))
+}
+
+// listSegments returns the first heights of all segments in ascending order
+func (store *SegmentStore) listSegments() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	firsts := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".idx") {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, ".idx"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment index file name: %s", name)
+		}
+		firsts = append(firsts, first)
+	}
+
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+	return firsts, nil
+}
+
+// openSegment opens the segment for writing, it is created when missing
+func (store *SegmentStore) openSegment(first uint64) (*segment, error) {
+	if store.readOnly {
+		return store.openSegmentFlag(first, os.O_RDONLY)
+	}
+	return store.openSegmentFlag(first, os.O_RDWR|os.O_CREATE)
+}
+
+func (store *SegmentStore) openSegmentFlag(first uint64, flag int) (*segment, error) {
+	data, err := os.OpenFile(store.segmentPath(first, ".seg"), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(store.segmentPath(first, ".idx"), flag, 0644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	seg := &segment{first: first, data: data, index: index}
+
+	dataInfo, err := data.Stat()
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	indexInfo, err := index.Stat()
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+
+	// A partial entry at the end of the index is dropped by the repair
+	seg.count = uint64(indexInfo.Size() / segmentIndexEntrySize)
+	seg.size = dataInfo.Size()
+
+	return seg, nil
+}
+
+// removeSegments deletes the segments, index files go first so a crash never
+// leaves an index without its data
+func (store *SegmentStore) removeSegments(firsts []uint64) error {
+	for i := len(firsts) - 1; i >= 0; i-- {
+		for _, ext := range []string{".idx", ".seg"} {
+			if err := os.Remove(store.segmentPath(firsts[i], ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return syncDir(store.dir)
+}
+
+// pruneSegments deletes the first segments of the store in ascending order, so a
+// crash never leaves a gap in the middle of the segments
+func (store *SegmentStore) pruneSegments(firsts []uint64) error {
+	for _, first := range firsts {
+		for _, ext := range []string{".idx", ".seg"} {
+			if err := os.Remove(store.segmentPath(first, ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return syncDir(store.dir)
+}
+
+// listOrphanData returns paths of segment data files without an index file
+func (store *SegmentStore) listOrphanData() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(store.dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []string{}
+	for _, path := range matches {
+		if !exists(strings.TrimSuffix(path, ".seg") + ".idx") {
+			orphans = append(orphans, path)
+		}
+	}
+
+	return orphans, nil
+}
+
+func (store *SegmentStore) readMeta() error {
+	path := filepath.Join(store.dir, segmentsMetaFilename)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && store.readOnly {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		// Segment size is fixed once the store is created
+		return store.writeMeta()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &store.meta); err != nil {
+		return err
+	}
+	if store.meta.SegmentSize == 0 {
+		return fmt.Errorf("invalid segment size in %s", path)
+	}
+
+	return nil
+}
+
+func (store *SegmentStore) writeMeta() error {
+	meta, err := json.MarshalIndent(store.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(store.dir, segmentsMetaFilename), meta, 0644)
+}
+
+// append writes the record at the end of the data file and adds its offset to the index
+// The record is synced before the index entry, so the index never points to
+// data that is not on disk. Without sync both are left for the next sync call.
+func (seg *segment) append(record []byte, sync bool) error {
+	if _, err := seg.data.WriteAt(record, seg.size); err != nil {
+		return err
+	}
+	if sync {
+		if err := seg.data.Sync(); err != nil {
+			return err
+		}
+	}
+
+	entry := make([]byte, segmentIndexEntrySize)
+	binary.BigEndian.PutUint64(entry, uint64(seg.size))
+
+	if _, err := seg.index.WriteAt(entry, int64(seg.count*segmentIndexEntrySize)); err != nil {
+		return err
+	}
+	if sync {
+		if err := seg.index.Sync(); err != nil {
+			return err
+		}
+	}
+
+	seg.size += int64(len(record))
+	seg.count++
+	if !sync {
+		seg.dirty = true
+	}
+
+	return nil
+}
+
+// sync flushes records appended without sync, the data before the index
+func (seg *segment) sync() error {
+	if !seg.dirty {
+		return nil
+	}
+
+	if err := seg.data.Sync(); err != nil {
+		return err
+	}
+	if err := seg.index.Sync(); err != nil {
+		return err
+	}
+
+	seg.dirty = false
+	return nil
+}
+
+// read returns the payload of the record at given position in the segment
+func (seg *segment) read(pos uint64) ([]byte, error) {
+	if pos >= seg.count {
+		return nil, ErrBlockNotFound
+	}
+
+	offset, err := seg.offset(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	return seg.readRecord(offset)
+}
+
+// readRecord returns the payload of the record at given data file offset
+func (seg *segment) readRecord(offset int64) ([]byte, error) {
+	header := make([]byte, segmentRecordHeaderSize)
+	if _, err := seg.data.ReadAt(header, offset); err != nil {
+		if err == io.EOF {
+			return nil, ErrSegmentCorrupted
+		}
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+segmentRecordHeaderSize+length > seg.size {
+		return nil, ErrSegmentCorrupted
+	}
+
+	payload := make([]byte, length)
+	if _, err := seg.data.ReadAt(payload, offset+segmentRecordHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, ErrSegmentCorrupted
+		}
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrSegmentCorrupted
+	}
+
+	return payload, nil
+}
+
+// offset returns the data file offset of the record at given position
+func (seg *segment) offset(pos uint64) (int64, error) {
+	entry := make([]byte, segmentIndexEntrySize)
+	if _, err := seg.index.ReadAt(entry, int64(pos*segmentIndexEntrySize)); err != nil {
+		return 0, err
+	}
+
+	return int64(binary.BigEndian.Uint64(entry)), nil
+}
+
+// truncate keeps the given number of records in the segment
+func (seg *segment) truncate(count uint64) error {
+	if count >= seg.count {
+		return nil
+	}
+
+	size, err := seg.offset(count)
+	if err != nil {
+		return err
+	}
+
+	// Index goes first, so it never points past the end of the data
+	if err := seg.index.Truncate(int64(count * segmentIndexEntrySize)); err != nil {
+		return err
+	}
+	if err := seg.index.Sync(); err != nil {
+		return err
+	}
+	if err := seg.data.Truncate(size); err != nil {
+		return err
+	}
+	if err := seg.data.Sync(); err != nil {
+		return err
+	}
+
+	seg.count = count
+	seg.size = size
+
+	return nil
+}
+
+// repair drops a partial index entry, index entries of records that were not
+// completely written, and data that was written without its index entry.
+func (seg *segment) repair(recovery *storeRecovery) error {
+	info, err := seg.index.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size()%segmentIndexEntrySize != 0 {
+		recovery.fixed("segment %d index has a partial entry", seg.first)
+		if err := seg.index.Truncate(int64(seg.count * segmentIndexEntrySize)); err != nil {
+			return err
+		}
+	}
+
+	end := int64(0)
+	for seg.count > 0 {
+		offset, err := seg.offset(seg.count - 1)
+		if err != nil {
+			return err
+		}
+
+		payload, err := seg.readRecord(offset)
+		if err == nil {
+			end = offset + segmentRecordHeaderSize + int64(len(payload))
+			break
+		}
+		if err != ErrSegmentCorrupted {
+			return err
+		}
+
+		recovery.fixed("segment %d record of block %d is incomplete", seg.first, seg.first+seg.count-1)
+		seg.count--
+		if err := seg.index.Truncate(int64(seg.count * segmentIndexEntrySize)); err != nil {
+			return err
+		}
+	}
+
+	if seg.size > end {
+		recovery.fixed("segment %d has %d bytes of data without index entries", seg.first, seg.size-end)
+		if err := seg.data.Truncate(end); err != nil {
+			return err
+		}
+		seg.size = end
+	}
+
+	if err := seg.index.Sync(); err != nil {
+		return err
+	}
+	return seg.data.Sync()
+}
+
+func (seg *segment) close() error {
+	if err := seg.sync(); err != nil {
+		seg.data.Close()
+		seg.index.Close()
+		return err
+	}
+
+	err := seg.data.Close()
+	if indexErr := seg.index.Close(); err == nil {
+		err = indexErr
+	}
+	return err
+}
@@ -0,0 +1,411 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testTip = 20
+
+func TestStoreRepair(t *testing.T) {
+	cases := []struct {
+		name    string
+		backend string
+		damage  func(t *testing.T, dir string)
+
+		// Problems reported by verify on the damaged store, as height and check
+		problems map[uint64]string
+
+		// Tip once the store is repaired, and files removed by the repair
+		tip     uint64
+		removed []string
+	}{
+		{
+			name:    "torn block file",
+			backend: StoreBackendJSON,
+			damage: func(t *testing.T, dir string) {
+				truncateFile(t, filepath.Join(dir, "blocks", "20.json"), -100)
+			},
+			problems: map[uint64]string{20: CheckDecode},
+			tip:      19,
+			removed:  []string{"blocks/20.json"},
+		},
+		{
+			name:    "tip ahead of the block files",
+			backend: StoreBackendJSON,
+			damage: func(t *testing.T, dir string) {
+				updateJSON(t, filepath.Join(dir, "meta.json"), "tip_height", 23)
+			},
+			problems: map[uint64]string{21: CheckMissing, 22: CheckMissing, 23: CheckMissing},
+			tip:      20,
+		},
+		{
+			name:    "block file above the tip",
+			backend: StoreBackendJSON,
+			damage: func(t *testing.T, dir string) {
+				updateJSON(t, filepath.Join(dir, "meta.json"), "tip_height", 18)
+			},
+			problems: map[uint64]string{},
+			tip:      18,
+			removed:  []string{"blocks/19.json", "blocks/20.json"},
+		},
+		{
+			name:    "unfinished write",
+			backend: StoreBackendJSON,
+			damage: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "blocks", "21.json.tmp"), []byte("{\"height\": 2"))
+			},
+			problems: map[uint64]string{},
+			tip:      20,
+			removed:  []string{"blocks/21.json.tmp"},
+		},
+		{
+			name:    "corrupted meta file",
+			backend: StoreBackendJSON,
+			damage: func(t *testing.T, dir string) {
+				truncateFile(t, filepath.Join(dir, "meta.json"), -10)
+			},
+			problems: map[uint64]string{},
+			tip:      20,
+		},
+		{
+			name:    "torn block record",
+			backend: StoreBackendSegments,
+			damage: func(t *testing.T, dir string) {
+				truncateFile(t, filepath.Join(dir, "segments", "0000000001.seg"), -100)
+			},
+			problems: map[uint64]string{20: CheckDecode},
+			tip:      19,
+		},
+		{
+			name:    "index entry past the data",
+			backend: StoreBackendSegments,
+			damage: func(t *testing.T, dir string) {
+				info, err := os.Stat(filepath.Join(dir, "segments", "0000000001.seg"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				entry := make([]byte, segmentIndexEntrySize)
+				binary.BigEndian.PutUint64(entry, uint64(info.Size()))
+				appendFile(t, filepath.Join(dir, "segments", "0000000001.idx"), entry)
+			},
+			problems: map[uint64]string{21: CheckDecode},
+			tip:      20,
+		},
+		{
+			name:    "partial index entry",
+			backend: StoreBackendSegments,
+			damage: func(t *testing.T, dir string) {
+				appendFile(t, filepath.Join(dir, "segments", "0000000001.idx"), []byte{0, 0, 1})
+			},
+			problems: map[uint64]string{},
+			tip:      20,
+		},
+		{
+			name:    "data without index entry",
+			backend: StoreBackendSegments,
+			damage: func(t *testing.T, dir string) {
+				appendFile(t, filepath.Join(dir, "segments", "0000000001.seg"), []byte("partial record"))
+			},
+			problems: map[uint64]string{},
+			tip:      20,
+		},
+		{
+			// Only the records at the end of the last segment can be left incomplete
+			// by a crash, a damaged record below the tip is reported by verify
+			name:    "corrupted record below the tip",
+			backend: StoreBackendSegments,
+			damage: func(t *testing.T, dir string) {
+				idx := readFile(t, filepath.Join(dir, "segments", "0000000001.idx"))
+				offset := binary.BigEndian.Uint64(idx[9*segmentIndexEntrySize:])
+
+				path := filepath.Join(dir, "segments", "0000000001.seg")
+				data := readFile(t, path)
+				data[offset+segmentRecordHeaderSize+10] ^= 0xff
+				writeFile(t, path, data)
+			},
+			problems: map[uint64]string{10: CheckDecode},
+			tip:      20,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			generateBlocks(t, c.backend, dir, 1, testTip)
+
+			c.damage(t, dir)
+
+			report := verifyDir(t, dir)
+			if len(report.Problems) != len(c.problems) {
+				t.Errorf("verify reported %d problems, want %d: %+v", len(report.Problems), len(c.problems), report.Problems)
+			}
+			for _, problem := range report.Problems {
+				if check, ok := c.problems[problem.Height]; !ok || check != problem.Check {
+					t.Errorf("unexpected %s problem at height %d: %s", problem.Check, problem.Height, problem.Message)
+				}
+			}
+			if report.Valid != (len(c.problems) == 0) {
+				t.Errorf("verify reported valid %v", report.Valid)
+			}
+
+			store, err := NewStore(c.backend, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The node checks the repaired blocks against the account state
+			node := newTestNode(store)
+			if err := node.Initialize(); err != nil {
+				store.Close()
+				t.Fatalf("cant initialize node on the repaired store: %v", err)
+			}
+
+			tip := store.TipHeight()
+			if tip != c.tip {
+				t.Errorf("repaired store tip is %d, want %d", tip, c.tip)
+			}
+			for _, name := range c.removed {
+				if exists(filepath.Join(dir, name)) {
+					t.Errorf("%s was not removed", name)
+				}
+			}
+
+			// Dropped blocks are produced again on top of the repaired tip
+			err = node.Generate(context.Background(), tip+1, testTip+1)
+			store.Close()
+			if err != nil {
+				t.Fatalf("cant generate blocks after the repair: %v", err)
+			}
+
+			// Repairs are only needed once, except for what verify keeps reporting
+			report = verifyDir(t, dir)
+			if report.TipHeight != testTip+1 {
+				t.Errorf("verify reported tip %d after the repair, want %d", report.TipHeight, testTip+1)
+			}
+			for _, problem := range report.Problems {
+				if check, ok := c.problems[problem.Height]; !ok || check != problem.Check || problem.Height > c.tip {
+					t.Errorf("unexpected %s problem at height %d after the repair: %s", problem.Check, problem.Height, problem.Message)
+				}
+			}
+		})
+	}
+}
+
+// The account state is written after the block, a crash in between leaves the
+// state behind the tip. The blocks above it are dropped and produced again.
+func TestStoreRepairStateBehindTip(t *testing.T) {
+	for _, backend := range []string{StoreBackendJSON, StoreBackendSegments} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			statePath := filepath.Join(dir, stateFilename)
+
+			generateBlocks(t, backend, dir, 1, 15)
+			state := readFile(t, statePath)
+
+			generateBlocks(t, backend, dir, 16, testTip)
+			writeFile(t, statePath, state)
+
+			report := verifyDir(t, dir)
+			if !report.Valid || report.TipHeight != testTip {
+				t.Errorf("verify reported valid %v at tip %d, want a valid store at tip %d", report.Valid, report.TipHeight, testTip)
+			}
+
+			store, err := NewStore(backend, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			node := newTestNode(store)
+			if err := node.Initialize(); err != nil {
+				t.Fatalf("cant initialize node: %v", err)
+			}
+			if tip := store.TipHeight(); tip != 15 {
+				t.Errorf("repaired store tip is %d, want 15", tip)
+			}
+
+			// The dropped blocks are produced again on top of the state
+			if err := node.Generate(context.Background(), 16, testTip); err != nil {
+				t.Fatalf("cant generate blocks after the repair: %v", err)
+			}
+			store.Close()
+
+			report = verifyDir(t, dir)
+			if !report.Valid || report.TipHeight != testTip {
+				t.Errorf("verify reported valid %v at tip %d after the repair: %+v", report.Valid, report.TipHeight, report.Problems)
+			}
+		})
+	}
+}
+
+// A block written at or below the tip replaces the stored blocks from its height
+// on, none of them may come back when the store is opened again.
+func TestStoreReplaceBlocks(t *testing.T) {
+	for _, backend := range []string{StoreBackendJSON, StoreBackendSegments} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			generateBlocks(t, backend, dir, 1, testTip)
+
+			store, err := NewStore(backend, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Initialize(); err != nil {
+				t.Fatal(err)
+			}
+
+			block, err := store.ReadBlock(15)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.WriteBlock(block); err != nil {
+				t.Fatalf("cant replace block 15: %v", err)
+			}
+			if tip := store.TipHeight(); tip != 15 {
+				t.Errorf("store tip is %d after replacing block 15, want 15", tip)
+			}
+			if _, err := store.ReadBlock(16); err == nil {
+				t.Error("block 16 is still readable after replacing block 15")
+			}
+
+			block.Height = 17
+			if err := store.WriteBlock(block); err == nil {
+				t.Error("block 17 was written right after the tip 15")
+			}
+			if tip := store.TipHeight(); tip != 15 {
+				t.Errorf("store tip is %d after a rejected write, want 15", tip)
+			}
+			store.Close()
+
+			for h := 16; h <= testTip; h++ {
+				if name := filepath.Join(dir, "blocks", fmt.Sprintf("%d.json", h)); exists(name) {
+					t.Errorf("%s was not removed", name)
+				}
+			}
+
+			store, err = NewStore(backend, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			if err := store.Initialize(); err != nil {
+				t.Fatal(err)
+			}
+			if tip := store.TipHeight(); tip != 15 {
+				t.Errorf("reopened store tip is %d, want 15", tip)
+			}
+		})
+	}
+}
+
+func newTestNode(store Store) *Node {
+	return NewNode(
+		store,
+		time.Second,
+		1,
+		ForkConfig{},
+		FinalityConfig{Mode: FinalityModeDepth, Depth: 1},
+		MempoolConfig{Size: 100, BlockLimit: 10},
+		42,
+	)
+}
+
+// generateBlocks writes a seeded chain from one height to another into the store
+// directory, the first height must follow the store tip
+func generateBlocks(t *testing.T, backend string, dir string, from uint64, to uint64) {
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	store, err := NewStore(backend, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	node := newTestNode(store)
+	if err := node.Initialize(); err != nil {
+		t.Fatalf("cant initialize node: %v", err)
+	}
+	if err := node.Generate(context.Background(), from, to); err != nil {
+		t.Fatalf("cant generate blocks: %v", err)
+	}
+}
+
+func verifyDir(t *testing.T, dir string) *VerifyReport {
+	store, err := OpenStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.Initialize(); err != nil {
+		t.Fatalf("cant open store: %v", err)
+	}
+
+	producer, err := LoadProducerKey(dir, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return VerifyStore(store, producer.PublicKey)
+}
+
+func readFile(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// truncateFile cuts the given number of bytes off the end of the file
+func truncateFile(t *testing.T, path string, delta int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()+delta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func updateJSON(t *testing.T, path string, key string, value interface{}) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(readFile(t, path), &fields); err != nil {
+		t.Fatal(err)
+	}
+	fields[key] = value
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, data)
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// Checks performed on every stored block
+const (
+	CheckMissing   = "missing"
+	CheckDecode    = "decode"
+	CheckHeight    = "height"
+	CheckHash      = "hash"
+	CheckSignature = "signature"
+	CheckProducer  = "producer"
+	CheckTxHash    = "tx_hash"
+	CheckTxRoot    = "tx_root"
+	CheckPrevHash  = "prev_hash"
+	CheckTimestamp = "timestamp"
+)
+
+// VerifyProblem describes a failed check of the block at given height
+type VerifyProblem struct {
+	Height  uint64 `json:"height"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// VerifyReport is the result of a store integrity check
+type VerifyReport struct {
+	Dir         string          `json:"dir"`
+	StartHeight uint64          `json:"start_height"`
+	TipHeight   uint64          `json:"tip_height"`
+	Checked     uint64          `json:"checked"`
+	Valid       bool            `json:"valid"`
+	Problems    []VerifyProblem `json:"problems"`
+}
+
+func (r *VerifyReport) add(height uint64, check string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, VerifyProblem{
+		Height:  height,
+		Check:   check,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// VerifyStore walks all blocks from the start to the tip height and checks that
+// every block is present and readable, carries valid hashes and a valid
+// signature of the producer, and links to its parent with a later timestamp.
+// Without a producer public key, all blocks must be signed by the producer of
+// the first readable block.
+func VerifyStore(store Store, producer ed25519.PublicKey) *VerifyReport {
+	report := &VerifyReport{
+		Dir:         store.Dir(),
+		StartHeight: store.StartHeight(),
+		TipHeight:   store.TipHeight(),
+		Problems:    []VerifyProblem{},
+	}
+
+	lastReport := time.Now()
+
+	// Linkage is only checked when the parent block could be read
+	var parent *types.Block
+
+	for height := report.StartHeight; height > 0 && height <= report.TipHeight; height++ {
+		report.Checked++
+
+		block, err := store.ReadBlock(height)
+		if errors.Is(err, ErrBlockNotFound) {
+			report.add(height, CheckMissing, "block is missing")
+			parent = nil
+			continue
+		}
+		if err != nil {
+			report.add(height, CheckDecode, "cant decode block: %v", err)
+			parent = nil
+			continue
+		}
+
+		if producer == nil {
+			producer = blockPublicKey(block)
+		}
+
+		verifyBlock(report, height, block, parent, producer)
+		parent = block
+
+		if time.Since(lastReport) >= progressReportInterval {
+			lastReport = time.Now()
+			logrus.WithField("height", height).WithField("tip", report.TipHeight).Info("verification progress")
+		}
+	}
+
+	report.Valid = len(report.Problems) == 0
+	return report
+}
+
+func verifyBlock(report *VerifyReport, height uint64, block *types.Block, parent *types.Block, producer ed25519.PublicKey) {
+	if block.Height != height {
+		report.add(height, CheckHeight, "block has height %d", block.Height)
+	}
+
+	if err := VerifyBlock(block, producer); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidBlockHash):
+			report.add(height, CheckHash, "%v", err)
+		case errors.Is(err, ErrInvalidTxHash):
+			report.add(height, CheckTxHash, "%v", err)
+		case errors.Is(err, ErrInvalidTxRoot):
+			report.add(height, CheckTxRoot, "%v", err)
+		case errors.Is(err, ErrUnexpectedProducer):
+			report.add(height, CheckProducer, "%v", err)
+		default:
+			report.add(height, CheckSignature, "%v", err)
+		}
+	}
+
+	if parent == nil {
+		return
+	}
+
+	if block.PrevHash != parent.Hash {
+		report.add(height, CheckPrevHash, "previous hash is %s, block %d has hash %s", block.PrevHash, parent.Height, parent.Hash)
+	}
+
+	if !block.Timestamp.After(parent.Timestamp) {
+		report.add(height, CheckTimestamp, "timestamp %s is not after the parent timestamp %s",
+			block.Timestamp.Format(time.RFC3339Nano), parent.Timestamp.Format(time.RFC3339Nano))
+	}
+}
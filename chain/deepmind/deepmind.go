@@ -3,91 +3,226 @@ package deepmind
 import (
 	"encoding/base64"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
 
+	"github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/proto"
 
 	pbcodec "github.com/figment-networks/graph-instrumentation-example/chain/proto"
 	"github.com/figment-networks/graph-instrumentation-example/chain/types"
 )
 
+// ProtocolVersion is announced on the INIT line, readers refuse the versions they
+// don't support. It must be increased on every incompatible change of the lines
+// or the protobuf messages they carry.
+const ProtocolVersion = 2
+
+const (
+	// The whole block is written as a single BLOCK line
+	ModeBlock = "block"
+
+	// Every transaction, balance change and event is written on its own line,
+	// followed by the block header, so the line size does not grow with the block size.
+	ModeTransactions = "trx"
+)
+
 var (
 	Enabled bool
 	writer  io.WriteCloser
+	mode    = ModeBlock
+
+	// Output offset of the block or rollback being written, -1 when the output
+	// can't be truncated
+	blockStart int64 = -1
+
+	// CRC32C of the payloads of the block being written, in line order
+	checksumTable = crc32.MakeTable(crc32.Castagnoli)
+	blockChecksum = crc32.New(checksumTable)
 )
 
-func Enable(w io.WriteCloser) {
+// truncater is an output that AbortBlock cuts back to the start of the block,
+// like a regular file
+type truncater interface {
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// Enable starts the output with the INIT line, which tells readers the protocol
+// version, the chain and the node version that produced the stream
+func Enable(w io.WriteCloser, chainID string, nodeVersion string) error {
 	Enabled = true
 	writer = w
+
+	return writeLine("DMLOG INIT %d %s %s\n", ProtocolVersion, chainID, nodeVersion)
 }
 
 func SetWriter(w io.WriteCloser) {
 	writer = w
 }
 
+// SetMode selects how the block data is written, see ModeBlock and ModeTransactions
+func SetMode(m string) error {
+	switch m {
+	case ModeBlock, ModeTransactions:
+		mode = m
+		return nil
+	default:
+		return fmt.Errorf("unsupported deepmind mode: %q", m)
+	}
+}
+
 func Shutdown() {
-	writer.Close()
+	if err := writer.Close(); err != nil {
+		logrus.WithError(err).Error("cant close deepmind output")
+	}
 }
 
 // BeginBlock marks the beginning of the block data for a single height
-func BeginBlock(number uint64) {
-	fmt.Fprintf(writer, "DMLOG BLOCK_BEGIN %d\n", number)
+func BeginBlock(number uint64) error {
+	markStart()
+	blockChecksum.Reset()
+
+	return writeLine("DMLOG BLOCK_BEGIN %d\n", number)
 }
 
-// Block writes all block data
-func Block(block *types.Block) {
-	newBlock := &pbcodec.Block{
-		Height:       block.Height,
-		Hash:         block.Hash,
-		PrevHash:     block.PrevHash,
-		Transactions: make([]*pbcodec.Transaction, len(block.Transactions)),
-		Timestamp:    uint64(block.Timestamp.UnixNano()),
+// AbortBlock removes the partial output of a block or rollback that failed to be
+// written, so it can be written again. Outputs that can't be truncated get a line break
+// instead, which ends a partially written line before the block starts over. Readers
+// skip such a line when it is followed by the BLOCK_BEGIN line of the same block.
+func AbortBlock() error {
+	file, ok := writer.(truncater)
+	if !ok || blockStart < 0 {
+		return writeLine("\n")
 	}
 
+	if err := file.Truncate(blockStart); err != nil {
+		return fmt.Errorf("cant truncate deepmind output: %w", err)
+	}
+	if _, err := file.Seek(blockStart, io.SeekStart); err != nil {
+		return fmt.Errorf("cant truncate deepmind output: %w", err)
+	}
+	return nil
+}
+
+// Block writes all block data, along with the balance changes made by each
+// transaction when they are known
+func Block(block *types.Block, balanceChanges [][]types.BalanceChange) error {
+	pbBlock := pbcodec.FromTracedBlock(block, balanceChanges)
+
+	if mode == ModeTransactions {
+		return transactions(pbBlock)
+	}
+
+	data, checksum, err := encode(pbBlock)
+	if err != nil {
+		return err
+	}
+	return writeLine("DMLOG BLOCK %08x %s\n", checksum, data)
+}
+
+// transactions writes each transaction with its balance changes and events, and
+// then the block header with the number of transactions it contains.
+func transactions(block *pbcodec.Block) error {
 	for idx, tx := range block.Transactions {
-		events := make([]*pbcodec.Event, len(tx.Events))
+		events := tx.Events
+
+		header := proto.Clone(tx).(*pbcodec.Transaction)
+		header.Events = nil
+		header.BalanceChanges = nil
 
-		for idxEv, ev := range tx.Events {
-			events[idxEv] = &pbcodec.Event{
-				Type: ev.Type,
+		data, _, err := encode(header)
+		if err != nil {
+			return err
+		}
+		if err := writeLine("DMLOG TRX_BEGIN %d %d %d %s\n", block.Height, idx, tx.BeginOrdinal, data); err != nil {
+			return err
+		}
+
+		for idxCh, change := range tx.BalanceChanges {
+			data, _, err := encode(change)
+			if err != nil {
+				return err
+			}
+			if err := writeLine("DMLOG BALANCE_CHANGE %d %d %d %d %s\n", block.Height, idx, idxCh, change.Ordinal, data); err != nil {
+				return err
 			}
+		}
 
-			for _, attr := range ev.Attributes {
-				events[idxEv].Attributes = append(events[idxEv].Attributes, &pbcodec.Attribute{
-					Key:   attr.Key,
-					Value: attr.Value,
-				})
+		for idxEv, ev := range events {
+			data, _, err := encode(ev)
+			if err != nil {
+				return err
+			}
+			if err := writeLine("DMLOG EVENT %d %d %d %d %s\n", block.Height, idx, idxEv, ev.Ordinal, data); err != nil {
+				return err
 			}
 		}
 
-		newBlock.Transactions[idx] = &pbcodec.Transaction{
-			Type:     tx.Type,
-			Hash:     tx.Hash,
-			Sender:   tx.Sender,
-			Receiver: tx.Receiver,
-			Amount: &pbcodec.BigInt{
-				Bytes: tx.Amount.Bytes(),
-			},
-			Fee: &pbcodec.BigInt{
-				Bytes: tx.Fee.Bytes(),
-			},
-			Success: tx.Success,
-			Events:  events,
+		if err := writeLine("DMLOG TRX_END %d %d %d %d\n", block.Height, idx, tx.EndOrdinal, len(events)); err != nil {
+			return err
 		}
 	}
 
-	data, err := proto.Marshal(newBlock)
+	header := proto.Clone(block).(*pbcodec.Block)
+	header.Transactions = nil
+
+	data, _, err := encode(header)
 	if err != nil {
-		// Terminating the app here will cause the chain to halt so it does not
-		// advance to a new block.
-		log.Fatal(err)
+		return err
+	}
+	return writeLine("DMLOG BLOCK_HEADER %d %d %s\n", block.Height, len(block.Transactions), data)
+}
+
+// EndBlock marks the end of the block data for a single height, with the
+// checksum of all payloads written for the block
+func EndBlock(number uint64) error {
+	if err := writeLine("DMLOG BLOCK_END %d %08x\n", number, blockChecksum.Sum32()); err != nil {
+		return err
 	}
 
-	fmt.Fprintf(writer, "DMLOG BLOCK %s\n", base64.StdEncoding.EncodeToString(data))
+	blockStart = -1
+	return nil
 }
 
-// EndBlock marks the end of the block data for a single height
-func EndBlock(number uint64) {
-	fmt.Fprintf(writer, "DMLOG BLOCK_END %d\n", number)
+// Rollback announces that the chain was rewound from given height back to the
+// block with given height and hash. Blocks emitted next build on top of it.
+func Rollback(number uint64, hash string, fromNumber uint64) error {
+	markStart()
+	if err := writeLine("DMLOG ROLLBACK %d %s %d\n", number, hash, fromNumber); err != nil {
+		return err
+	}
+
+	blockStart = -1
+	return nil
+}
+
+// markStart keeps the output offset the next lines are written at
+func markStart() {
+	blockStart = -1
+	if file, ok := writer.(truncater); ok {
+		if offset, err := file.Seek(0, io.SeekEnd); err == nil {
+			blockStart = offset
+		}
+	}
+}
+
+func writeLine(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(writer, format, args...); err != nil {
+		return fmt.Errorf("cant write deepmind output: %w", err)
+	}
+	return nil
+}
+
+// encode returns the base64 payload of the message and its CRC32C checksum, the
+// payload is added to the checksum of the block as well
+func encode(message proto.Message) (string, uint32, error) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return "", 0, fmt.Errorf("cant encode %s: %w", message.ProtoReflect().Descriptor().Name(), err)
+	}
+
+	blockChecksum.Write(data)
+
+	return base64.StdEncoding.EncodeToString(data), crc32.Checksum(data, checksumTable), nil
 }
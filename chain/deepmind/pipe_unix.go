@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package deepmind
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// openPipe opens the named pipe without waiting for a reader, it fails until
+// a reader has the pipe open.
+func openPipe(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+}
@@ -0,0 +1,10 @@
+package deepmind
+
+import (
+	"errors"
+	"io"
+)
+
+func openPipe(path string) (io.WriteCloser, error) {
+	return nil, errors.New("named pipes are not supported on windows")
+}
@@ -0,0 +1,372 @@
+package deepmind
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RotationConfig limits the size of the output file, a limit of 0 is disabled
+type RotationConfig struct {
+	// Size in bytes and number of blocks after which the file is rotated
+	MaxSize   int64
+	MaxBlocks uint64
+
+	// Number of rotated files kept, older ones are removed (0 keeps all files)
+	Retain int
+}
+
+func (c RotationConfig) Enabled() bool {
+	return c.MaxSize > 0 || c.MaxBlocks > 0
+}
+
+// rotatingFile writes the output to a file that is renamed after the range of
+// block heights it holds once it reaches the size or blocks limit, and a new file
+// is started. Files are only rotated after a BLOCK_END line, so every block is
+// contained in a single file, and each new file starts with the INIT line.
+type rotatingFile struct {
+	path   string
+	config RotationConfig
+
+	file   *os.File
+	size   int64
+	blocks uint64
+	init   []byte
+
+	// Heights of the first and the last block of the file
+	first uint64
+	last  uint64
+
+	// Sequence number of the next rotated file
+	seq uint64
+}
+
+// NewRotatingFile appends the output to the file at path and rotates it according
+// to the config. Rotated files are named <name>-<sequence>-<first height>-<last height><ext>
+// next to it, see parseRotatedFilename. The sequence number follows the one of
+// the last rotated file left in the directory.
+func NewRotatingFile(path string, config RotationConfig) (io.WriteCloser, error) {
+	w := &rotatingFile{path: path, config: config}
+
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+	if err := w.loadSequence(); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Write expects whole lines, as written by the deepmind functions
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	switch {
+	case bytes.HasPrefix(p, initPrefix):
+		w.init = append([]byte(nil), p...)
+	case bytes.HasPrefix(p, blockBeginPrefix):
+		if w.first == 0 {
+			w.first = parseLineHeight(p, blockBeginPrefix)
+		}
+	case bytes.HasPrefix(p, blockEndPrefix):
+		w.last = parseLineHeight(p, blockEndPrefix)
+		w.blocks++
+
+		if w.full() {
+			if err := w.rotate(); err != nil {
+				return n, fmt.Errorf("cant rotate deepmind output file: %w", err)
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Seek and Truncate apply to the file being written, so a failed block can be
+// removed from it
+func (w *rotatingFile) Seek(offset int64, whence int) (int64, error) {
+	return w.file.Seek(offset, whence)
+}
+
+func (w *rotatingFile) Truncate(size int64) error {
+	// The block was complete when the file failed to rotate
+	if size > w.size {
+		return errors.New("deepmind output file was rotated")
+	}
+
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	w.size = size
+	return nil
+}
+
+func (w *rotatingFile) Close() error {
+	return w.file.Close()
+}
+
+func (w *rotatingFile) full() bool {
+	return (w.config.MaxSize > 0 && w.size >= w.config.MaxSize) ||
+		(w.config.MaxBlocks > 0 && w.blocks >= w.config.MaxBlocks)
+}
+
+func (w *rotatingFile) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	return nil
+}
+
+func (w *rotatingFile) rotate() error {
+	target := w.rotatedPath()
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, target); err != nil {
+		return err
+	}
+	w.seq++
+
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	logrus.WithField("path", target).Debug("rotated deepmind output file")
+
+	w.size = 0
+	w.blocks = 0
+	w.first = 0
+	w.last = 0
+
+	if w.init != nil {
+		n, err := w.file.Write(w.init)
+		w.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.removeExpired()
+}
+
+func (w *rotatingFile) rotatedPath() string {
+	dir, base := filepath.Split(w.path)
+	ext := filepath.Ext(base)
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%06d-%010d-%010d%s", strings.TrimSuffix(base, ext), w.seq, w.first, w.last, ext))
+}
+
+// rotatedFiles returns the rotated files of the output, in the order they were rotated
+func (w *rotatingFile) rotatedFiles() ([]string, error) {
+	base := filepath.Base(w.path)
+	ext := filepath.Ext(base)
+
+	return listRotatedFiles(filepath.Dir(w.path), strings.TrimSuffix(base, ext)+"-", ext)
+}
+
+// loadSequence continues the sequence of the rotated files left in the directory
+func (w *rotatingFile) loadSequence() error {
+	files, err := w.rotatedFiles()
+	if err != nil {
+		return err
+	}
+
+	w.seq = 1
+	if len(files) > 0 {
+		seq, _, _, err := parseRotatedFilename(filepath.Base(files[len(files)-1]))
+		if err != nil {
+			return err
+		}
+		w.seq = seq + 1
+	}
+
+	return nil
+}
+
+// removeExpired removes the oldest rotated files beyond the retained number
+func (w *rotatingFile) removeExpired() error {
+	if w.config.Retain <= 0 {
+		return nil
+	}
+
+	files, err := w.rotatedFiles()
+	if err != nil {
+		return err
+	}
+
+	for len(files) > w.config.Retain {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// recover reads the file left by a previous run, so the next rotation covers all
+// of its blocks. A block the previous run did not finish is cut off, the output
+// resumes with whole blocks.
+func (w *rotatingFile) recover() error {
+	file, err := os.OpenFile(w.path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	var offset, complete int64
+	var inBlock bool
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF {
+			// Unterminated last line
+			break
+		}
+		offset += int64(len(line))
+
+		switch {
+		case bytes.HasPrefix(line, blockBeginPrefix):
+			if w.first == 0 {
+				w.first = parseLineHeight(line, blockBeginPrefix)
+			}
+			inBlock = true
+		case bytes.HasPrefix(line, blockEndPrefix):
+			w.last = parseLineHeight(line, blockEndPrefix)
+			w.blocks++
+			inBlock = false
+		}
+
+		if !inBlock {
+			complete = offset
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > complete {
+		logrus.WithField("path", w.path).WithField("size", info.Size()-complete).Warn("removing unfinished block from deepmind output file")
+		if err := file.Truncate(complete); err != nil {
+			return err
+		}
+	}
+
+	if w.blocks == 0 {
+		w.first = 0
+	}
+	w.size = complete
+
+	return nil
+}
+
+// parseRotatedFilename returns the sequence number and height range of a rotated
+// output file name
+func parseRotatedFilename(name string) (seq uint64, first uint64, last uint64, err error) {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	// Sequence numbers are zero padded to 6 digits at least, heights to 10
+	parts := strings.Split(name, "-")
+	if len(parts) < 4 {
+		return 0, 0, 0, errors.New("name has no sequence number and height range")
+	}
+	parts = parts[len(parts)-3:]
+	if len(parts[0]) < 6 || len(parts[1]) < 10 || len(parts[2]) < 10 {
+		return 0, 0, 0, errors.New("name has no sequence number and height range")
+	}
+
+	if seq, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid sequence number: %w", err)
+	}
+	if first, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid first height: %w", err)
+	}
+	if last, err = strconv.ParseUint(parts[2], 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid last height: %w", err)
+	}
+
+	return seq, first, last, nil
+}
+
+// listRotatedFiles returns the paths of the rotated output files of the directory
+// with given name prefix and suffix, in the order they were rotated. Files are
+// ordered by sequence number rather than by height, as a rollback lowers the
+// heights of the blocks that follow it.
+func listRotatedFiles(dir string, prefix string, suffix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type rotatedFile struct {
+		name string
+		seq  uint64
+	}
+
+	var files []rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		seq, _, _, err := parseRotatedFilename(name)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{name: name, seq: seq})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].seq < files[j].seq
+	})
+
+	paths := make([]string, len(files))
+	for idx, file := range files {
+		paths[idx] = filepath.Join(dir, file.name)
+	}
+
+	return paths, nil
+}
+
+// parseLineHeight returns the height following the line prefix, 0 when invalid
+func parseLineHeight(line []byte, prefix []byte) uint64 {
+	fields := bytes.Fields(line[len(prefix):])
+	if len(fields) == 0 {
+		return 0
+	}
+
+	height, _ := strconv.ParseUint(string(fields[0]), 10, 64)
+	return height
+}
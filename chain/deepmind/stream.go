@@ -0,0 +1,303 @@
+package deepmind
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Default amount of output kept in memory while the reader is away
+	DefaultBufferSize = 64 * 1024 * 1024
+
+	reconnectMinDelay = 100 * time.Millisecond
+	reconnectMaxDelay = 5 * time.Second
+
+	// Time given to a reader to receive the buffered output on shutdown
+	flushTimeout = 5 * time.Second
+)
+
+var (
+	initPrefix       = []byte("DMLOG INIT ")
+	blockBeginPrefix = []byte("DMLOG BLOCK_BEGIN ")
+	blockEndPrefix   = []byte("DMLOG BLOCK_END ")
+	rollbackPrefix   = []byte("DMLOG ROLLBACK ")
+)
+
+// IsSocketAddr tells if the output target is a unix:// or tcp:// socket address
+func IsSocketAddr(target string) bool {
+	return strings.HasPrefix(target, "unix://") || strings.HasPrefix(target, "tcp://")
+}
+
+// NewSocketWriter writes the output to a reader listening on a unix:///path or
+// tcp://host:port address, see NewStreamWriter.
+func NewSocketWriter(addr string, bufferSize int) (io.WriteCloser, error) {
+	var network, address string
+
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	default:
+		return nil, fmt.Errorf("unsupported socket address: %q", addr)
+	}
+
+	if address == "" {
+		return nil, fmt.Errorf("socket address %q has no path or host", addr)
+	}
+
+	dial := func() (io.WriteCloser, error) {
+		return net.Dial(network, address)
+	}
+
+	return NewStreamWriter(addr, dial, bufferSize), nil
+}
+
+// NewPipeWriter writes the output to an existing named pipe, see NewStreamWriter
+func NewPipeWriter(path string, bufferSize int) io.WriteCloser {
+	return NewStreamWriter(path, func() (io.WriteCloser, error) { return openPipe(path) }, bufferSize)
+}
+
+// streamWriter delivers the output to a reader that may come and go. Lines are
+// queued and written by a background goroutine, which connects again when the
+// reader goes away. Up to bufferSize bytes are kept while there is no reader,
+// then writes block until one connects, which stalls the node.
+//
+// A reader that connects after a block was partially written would not know
+// where it starts, so the lines of the unfinished block are written again first,
+// after the INIT line that every reader needs to see. A write only means the line
+// reached the connection, a reader that went away may still have lost the end of
+// the last block or rollback, so it's written again as well. The reader skips a
+// block it has already read.
+type streamWriter struct {
+	target     string
+	dial       func() (io.WriteCloser, error)
+	bufferSize int
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	pending  [][]byte
+	size     int
+	closed   bool
+	closedAt time.Time
+
+	// INIT line, lines of the last completed block or rollback, and lines of the
+	// unfinished block that were already written
+	init  []byte
+	last  [][]byte
+	block [][]byte
+
+	done chan struct{}
+}
+
+// NewStreamWriter returns a writer that queues the output for the connections
+// returned by dial. Each Write call must hold whole lines.
+func NewStreamWriter(target string, dial func() (io.WriteCloser, error), bufferSize int) io.WriteCloser {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	w := &streamWriter{
+		target:     target,
+		dial:       dial,
+		bufferSize: bufferSize,
+		done:       make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.lock)
+
+	go w.run()
+
+	return w
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// A line larger than the buffer still goes through once the queue is empty
+	if w.full(len(line)) {
+		logrus.WithField("target", w.target).WithField("size", w.size).Warn("deepmind output buffer is full, waiting for reader")
+		for w.full(len(line)) {
+			w.cond.Wait()
+		}
+	}
+	if w.closed {
+		return 0, errors.New("deepmind output is closed")
+	}
+
+	w.pending = append(w.pending, line)
+	w.size += len(line)
+	w.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (w *streamWriter) full(length int) bool {
+	return !w.closed && w.size > 0 && w.size+length > w.bufferSize
+}
+
+// Close waits for the queued output to be written, at most flushTimeout when
+// there is no reader.
+func (w *streamWriter) Close() error {
+	w.lock.Lock()
+	w.closed = true
+	w.closedAt = time.Now()
+	w.cond.Broadcast()
+	w.lock.Unlock()
+
+	// A connected reader that stopped reading blocks the writes as well
+	select {
+	case <-w.done:
+	case <-time.After(flushTimeout):
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.pending) > 0 {
+		return fmt.Errorf("%d deepmind output lines were not delivered to %s", len(w.pending), w.target)
+	}
+	return nil
+}
+
+func (w *streamWriter) run() {
+	defer close(w.done)
+
+	var conn io.WriteCloser
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		line, ok := w.next()
+		if !ok {
+			return
+		}
+
+		if conn == nil {
+			if conn = w.connect(); conn == nil {
+				return
+			}
+		}
+
+		if _, err := conn.Write(line); err != nil {
+			logrus.WithField("target", w.target).WithError(err).Warn("deepmind output reader went away, buffering output")
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		w.written(line)
+	}
+}
+
+// next waits for the next queued line, it returns false once the writer is
+// closed and all lines are written.
+func (w *streamWriter) next() ([]byte, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for len(w.pending) == 0 {
+		if w.closed {
+			return nil, false
+		}
+		w.cond.Wait()
+	}
+
+	return w.pending[0], true
+}
+
+// written removes the line from the queue and tracks the unfinished block
+func (w *streamWriter) written(line []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.pending[0] = nil
+	w.pending = w.pending[1:]
+	w.size -= len(line)
+	w.cond.Broadcast()
+
+	switch {
+	case bytes.HasPrefix(line, initPrefix):
+		w.init = line
+	case bytes.HasPrefix(line, blockBeginPrefix):
+		w.block = [][]byte{line}
+	case bytes.HasPrefix(line, blockEndPrefix):
+		w.last = append(w.block, line)
+		w.block = nil
+	case bytes.HasPrefix(line, rollbackPrefix):
+		w.last = [][]byte{line}
+	case w.block != nil:
+		w.block = append(w.block, line)
+	}
+}
+
+// connect retries until a reader accepts the connection and the INIT line, the
+// last completed block or rollback and the unfinished block are written to it. It gives up flushTimeout after the writer is closed.
+func (w *streamWriter) connect() io.WriteCloser {
+	delay := reconnectMinDelay
+	logged := false
+
+	for {
+		conn, err := w.dial()
+		if err == nil {
+			if err = w.replay(conn); err == nil {
+				logrus.WithField("target", w.target).Info("deepmind output reader connected")
+				return conn
+			}
+			conn.Close()
+		}
+
+		if !logged {
+			logrus.WithField("target", w.target).WithError(err).Warn("waiting for deepmind output reader")
+			logged = true
+		}
+
+		if w.givenUp() {
+			return nil
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+func (w *streamWriter) replay(conn io.Writer) error {
+	w.lock.Lock()
+	var lines [][]byte
+	if w.init != nil {
+		lines = append(lines, w.init)
+	}
+	lines = append(lines, w.last...)
+	lines = append(lines, w.block...)
+	w.lock.Unlock()
+
+	for _, line := range lines {
+		if _, err := conn.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *streamWriter) givenUp() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.closed && time.Since(w.closedAt) >= flushTimeout
+}
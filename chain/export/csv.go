@@ -0,0 +1,378 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+const (
+	csvBlocksFilename       = "blocks.csv"
+	csvTransactionsFilename = "transactions.csv"
+	csvEventsFilename       = "events.csv"
+)
+
+var (
+	csvBlocksHeader = []string{
+		"height", "hash", "prev_hash", "lib_num", "timestamp", "tx_root",
+		"producer", "public_key", "signature", "tx_count",
+	}
+
+	csvTransactionsHeader = []string{
+		"block_height", "index", "hash", "type", "sender", "receiver",
+		"amount", "fee", "nonce", "success", "event_count",
+	}
+
+	// Attributes are a JSON list of key and value pairs, since keys may repeat
+	csvEventsHeader = []string{
+		"block_height", "tx_index", "index", "type", "attributes",
+	}
+)
+
+// csvTable is a single CSV file of the export directory
+type csvTable struct {
+	file   *os.File
+	writer *csv.Writer
+	reader *csv.Reader
+	line   int
+}
+
+func createCSVTable(path string, header []string) (*csvTable, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &csvTable{file: file, writer: csv.NewWriter(file)}
+	if err := table.write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return table, nil
+}
+
+func openCSVTable(path string, header []string) (*csvTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &csvTable{file: file, reader: csv.NewReader(file)}
+	table.reader.FieldsPerRecord = len(header)
+	table.reader.ReuseRecord = true
+
+	row, err := table.read()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if strings.Join(row, ",") != strings.Join(header, ",") {
+		file.Close()
+		return nil, fmt.Errorf("%s: unexpected header %v", path, row)
+	}
+
+	return table, nil
+}
+
+func (t *csvTable) write(row []string) error {
+	return t.writer.Write(row)
+}
+
+func (t *csvTable) read() ([]string, error) {
+	t.line++
+	return t.reader.Read()
+}
+
+// errorf reports a problem in the last read line of the table
+func (t *csvTable) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s line %d: %s", filepath.Base(t.file.Name()), t.line, fmt.Sprintf(format, args...))
+}
+
+func (t *csvTable) close() error {
+	if t.writer != nil {
+		t.writer.Flush()
+		if err := t.writer.Error(); err != nil {
+			t.file.Close()
+			return err
+		}
+	}
+	return t.file.Close()
+}
+
+type csvWriter struct {
+	blocks       *csvTable
+	transactions *csvTable
+	events       *csvTable
+}
+
+func newCSVWriter(dir string) (*csvWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &csvWriter{}
+
+	tables := []struct {
+		table    **csvTable
+		filename string
+		header   []string
+	}{
+		{&w.blocks, csvBlocksFilename, csvBlocksHeader},
+		{&w.transactions, csvTransactionsFilename, csvTransactionsHeader},
+		{&w.events, csvEventsFilename, csvEventsHeader},
+	}
+
+	for _, t := range tables {
+		table, err := createCSVTable(filepath.Join(dir, t.filename), t.header)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		*t.table = table
+	}
+
+	return w, nil
+}
+
+func (w *csvWriter) WriteBlock(block *types.Block) error {
+	height := strconv.FormatUint(block.Height, 10)
+
+	err := w.blocks.write([]string{
+		height,
+		block.Hash,
+		block.PrevHash,
+		strconv.FormatUint(block.LibNum, 10),
+		block.Timestamp.UTC().Format(time.RFC3339Nano),
+		block.TxRoot,
+		block.Producer,
+		block.PublicKey,
+		block.Signature,
+		strconv.Itoa(len(block.Transactions)),
+	})
+	if err != nil {
+		return err
+	}
+
+	for idx, tx := range block.Transactions {
+		err := w.transactions.write([]string{
+			height,
+			strconv.Itoa(idx),
+			tx.Hash,
+			tx.Type,
+			tx.Sender,
+			tx.Receiver,
+			tx.Amount.String(),
+			tx.Fee.String(),
+			strconv.FormatUint(tx.Nonce, 10),
+			strconv.FormatBool(tx.Success),
+			strconv.Itoa(len(tx.Events)),
+		})
+		if err != nil {
+			return err
+		}
+
+		for idxEv, ev := range tx.Events {
+			attributes := ev.Attributes
+			if attributes == nil {
+				attributes = []types.Attribute{}
+			}
+
+			data, err := json.Marshal(attributes)
+			if err != nil {
+				return err
+			}
+
+			err = w.events.write([]string{
+				height,
+				strconv.Itoa(idx),
+				strconv.Itoa(idxEv),
+				ev.Type,
+				string(data),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *csvWriter) Close() error {
+	var err error
+
+	for _, table := range []*csvTable{w.blocks, w.transactions, w.events} {
+		if table == nil {
+			continue
+		}
+		if closeErr := table.close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+type csvReader struct {
+	blocks       *csvTable
+	transactions *csvTable
+	events       *csvTable
+}
+
+func newCSVReader(dir string) (*csvReader, error) {
+	r := &csvReader{}
+
+	tables := []struct {
+		table    **csvTable
+		filename string
+		header   []string
+	}{
+		{&r.blocks, csvBlocksFilename, csvBlocksHeader},
+		{&r.transactions, csvTransactionsFilename, csvTransactionsHeader},
+		{&r.events, csvEventsFilename, csvEventsHeader},
+	}
+
+	for _, t := range tables {
+		table, err := openCSVTable(filepath.Join(dir, t.filename), t.header)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		*t.table = table
+	}
+
+	return r, nil
+}
+
+// ReadBlock reads the next block row along with its transaction and event rows,
+// which follow each other in the same order in all tables.
+func (r *csvReader) ReadBlock() (*types.Block, error) {
+	row, err := r.blocks.read()
+	if err != nil {
+		return nil, err
+	}
+
+	block := &types.Block{
+		Hash:      row[1],
+		PrevHash:  row[2],
+		TxRoot:    row[5],
+		Producer:  row[6],
+		PublicKey: row[7],
+		Signature: row[8],
+	}
+
+	var txCount int
+	if block.Height, err = strconv.ParseUint(row[0], 10, 64); err != nil {
+		return nil, r.blocks.errorf("invalid height: %v", err)
+	}
+	if block.LibNum, err = strconv.ParseUint(row[3], 10, 64); err != nil {
+		return nil, r.blocks.errorf("invalid lib_num: %v", err)
+	}
+	if block.Timestamp, err = time.Parse(time.RFC3339Nano, row[4]); err != nil {
+		return nil, r.blocks.errorf("invalid timestamp: %v", err)
+	}
+	if txCount, err = strconv.Atoi(row[9]); err != nil {
+		return nil, r.blocks.errorf("invalid tx_count: %v", err)
+	}
+
+	block.Transactions = make([]types.Transaction, txCount)
+	for idx := range block.Transactions {
+		if err := r.readTransaction(block, idx); err != nil {
+			return nil, err
+		}
+	}
+
+	return block, nil
+}
+
+func (r *csvReader) readTransaction(block *types.Block, idx int) error {
+	row, err := r.transactions.read()
+	if err != nil {
+		return r.transactions.errorf("transaction %d of block %d: %v", idx, block.Height, err)
+	}
+	if err := checkCSVPosition(row[0:2], block.Height, idx); err != nil {
+		return r.transactions.errorf("%v", err)
+	}
+
+	tx := types.Transaction{
+		Hash:     row[2],
+		Type:     row[3],
+		Sender:   row[4],
+		Receiver: row[5],
+	}
+
+	var ok bool
+	if tx.Amount, ok = new(big.Int).SetString(row[6], 10); !ok {
+		return r.transactions.errorf("invalid amount: %q", row[6])
+	}
+	if tx.Fee, ok = new(big.Int).SetString(row[7], 10); !ok {
+		return r.transactions.errorf("invalid fee: %q", row[7])
+	}
+
+	var eventCount int
+	if tx.Nonce, err = strconv.ParseUint(row[8], 10, 64); err != nil {
+		return r.transactions.errorf("invalid nonce: %v", err)
+	}
+	if tx.Success, err = strconv.ParseBool(row[9]); err != nil {
+		return r.transactions.errorf("invalid success: %v", err)
+	}
+	if eventCount, err = strconv.Atoi(row[10]); err != nil {
+		return r.transactions.errorf("invalid event_count: %v", err)
+	}
+
+	tx.Events = make([]types.Event, eventCount)
+	for idxEv := range tx.Events {
+		row, err := r.events.read()
+		if err != nil {
+			return r.events.errorf("event %d of transaction %d in block %d: %v", idxEv, idx, block.Height, err)
+		}
+		if err := checkCSVPosition(row[0:3], block.Height, idx, idxEv); err != nil {
+			return r.events.errorf("%v", err)
+		}
+
+		tx.Events[idxEv].Type = row[3]
+		if err := json.Unmarshal([]byte(row[4]), &tx.Events[idxEv].Attributes); err != nil {
+			return r.events.errorf("invalid attributes: %v", err)
+		}
+	}
+
+	block.Transactions[idx] = tx
+	return nil
+}
+
+// checkCSVPosition makes sure the row belongs to the expected block height and indexes
+func checkCSVPosition(columns []string, height uint64, indexes ...int) error {
+	expected := []string{strconv.FormatUint(height, 10)}
+	for _, idx := range indexes {
+		expected = append(expected, strconv.Itoa(idx))
+	}
+
+	if strings.Join(columns, ",") != strings.Join(expected, ",") {
+		return fmt.Errorf("row is at position %v, expected %v", columns, expected)
+	}
+	return nil
+}
+
+func (r *csvReader) Close() error {
+	var err error
+
+	for _, table := range []*csvTable{r.blocks, r.transactions, r.events} {
+		if table == nil {
+			continue
+		}
+		if closeErr := table.close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,101 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+const (
+	// One JSON encoded block per line
+	FormatJSONL = "jsonl"
+
+	// Blocks, transactions and events tables in separate CSV files of a directory
+	FormatCSV = "csv"
+
+	// Protobuf encoded blocks, each prefixed with its varint encoded length
+	FormatProtobuf = "pb"
+)
+
+// Writer writes blocks in ascending height order
+type Writer interface {
+	WriteBlock(block *types.Block) error
+	Close() error
+}
+
+// Reader returns blocks in the order they were written, and io.EOF after the last one
+type Reader interface {
+	ReadBlock() (*types.Block, error)
+	Close() error
+}
+
+// NewWriter creates a writer of given format. The path is a directory for the CSV
+// format and a file for the others, where "-" writes to stdout.
+func NewWriter(format string, path string) (Writer, error) {
+	switch format {
+	case FormatJSONL, FormatProtobuf:
+		file, err := createFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if format == FormatJSONL {
+			return newJSONLWriter(file), nil
+		}
+		return newProtobufWriter(file), nil
+	case FormatCSV:
+		if path == "-" {
+			return nil, fmt.Errorf("%s format needs an output directory", format)
+		}
+		return newCSVWriter(path)
+	default:
+		return nil, fmt.Errorf("unsupported export format: %q", format)
+	}
+}
+
+// NewReader opens a reader of given format, see NewWriter for the path
+func NewReader(format string, path string) (Reader, error) {
+	switch format {
+	case FormatJSONL, FormatProtobuf:
+		file, err := openFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if format == FormatJSONL {
+			return newJSONLReader(file), nil
+		}
+		return newProtobufReader(file), nil
+	case FormatCSV:
+		if path == "-" {
+			return nil, fmt.Errorf("%s format needs an input directory", format)
+		}
+		return newCSVReader(path)
+	default:
+		return nil, fmt.Errorf("unsupported import format: %q", format)
+	}
+}
+
+func createFile(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+func openFile(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
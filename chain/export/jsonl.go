@@ -0,0 +1,61 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+type jsonlWriter struct {
+	file    io.WriteCloser
+	buf     *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newJSONLWriter(file io.WriteCloser) *jsonlWriter {
+	buf := bufio.NewWriter(file)
+
+	return &jsonlWriter{
+		file:    file,
+		buf:     buf,
+		encoder: json.NewEncoder(buf),
+	}
+}
+
+func (w *jsonlWriter) WriteBlock(block *types.Block) error {
+	return w.encoder.Encode(block)
+}
+
+func (w *jsonlWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+type jsonlReader struct {
+	file    io.ReadCloser
+	decoder *json.Decoder
+}
+
+func newJSONLReader(file io.ReadCloser) *jsonlReader {
+	return &jsonlReader{
+		file:    file,
+		decoder: json.NewDecoder(bufio.NewReader(file)),
+	}
+}
+
+func (r *jsonlReader) ReadBlock() (*types.Block, error) {
+	block := &types.Block{}
+	if err := r.decoder.Decode(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (r *jsonlReader) Close() error {
+	return r.file.Close()
+}
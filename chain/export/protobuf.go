@@ -0,0 +1,93 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+
+	pbcodec "github.com/figment-networks/graph-instrumentation-example/chain/proto"
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// Upper bound of a single encoded block, guards against reading garbage lengths
+const maxProtobufBlockSize = 64 << 20
+
+type protobufWriter struct {
+	file io.WriteCloser
+	buf  *bufio.Writer
+}
+
+func newProtobufWriter(file io.WriteCloser) *protobufWriter {
+	return &protobufWriter{
+		file: file,
+		buf:  bufio.NewWriter(file),
+	}
+}
+
+func (w *protobufWriter) WriteBlock(block *types.Block) error {
+	data, err := proto.Marshal(pbcodec.FromBlock(block))
+	if err != nil {
+		return err
+	}
+
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(data)))
+
+	if _, err := w.buf.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err = w.buf.Write(data)
+	return err
+}
+
+func (w *protobufWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+type protobufReader struct {
+	file io.ReadCloser
+	buf  *bufio.Reader
+}
+
+func newProtobufReader(file io.ReadCloser) *protobufReader {
+	return &protobufReader{
+		file: file,
+		buf:  bufio.NewReader(file),
+	}
+}
+
+func (r *protobufReader) ReadBlock() (*types.Block, error) {
+	length, err := binary.ReadUvarint(r.buf)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxProtobufBlockSize {
+		return nil, fmt.Errorf("block message of %d bytes exceeds the limit", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.buf, data); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	block := &pbcodec.Block{}
+	if err := proto.Unmarshal(data, block); err != nil {
+		return nil, err
+	}
+
+	return block.ToBlock(), nil
+}
+
+func (r *protobufReader) Close() error {
+	return r.file.Close()
+}
@@ -3,9 +3,11 @@ module github.com/figment-networks/graph-instrumentation-example/chain
 go 1.17
 
 require (
+	github.com/gorilla/websocket v1.5.0
 	github.com/jessevdk/go-flags v1.5.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.3.0
+	go.etcd.io/bbolt v1.3.6
 	google.golang.org/protobuf v1.27.1
 )
 
@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/figment-networks/graph-instrumentation-example/chain/core"
 	"github.com/figment-networks/graph-instrumentation-example/chain/deepmind"
+	"github.com/figment-networks/graph-instrumentation-example/chain/export"
+	"github.com/figment-networks/graph-instrumentation-example/chain/rpc"
 )
 
 var cliOpts = struct {
@@ -19,38 +27,80 @@ var cliOpts = struct {
 	LogLevel      string `long:"log-level" description:"Logging level" default:"info"`
 	StoreDir      string `long:"store-dir" description:"Directory for storing blocks data" default:"./data"`
 	BlockRate     int    `long:"block-rate" description:"Block production rate (per second)" default:"1"`
+	ForkInterval  uint64 `long:"fork-interval" description:"Number of blocks between simulated forks" default:"0"`
+	ReorgDepth    uint64 `long:"reorg-depth" description:"Number of blocks abandoned by a simulated reorg" default:"1"`
+	FinalityMode  string `long:"finality-mode" description:"Finality rule for the last irreversible block" default:"depth"`
+	FinalityDepth uint64 `long:"finality-depth" description:"Number of blocks until a block becomes irreversible" default:"1"`
+	Validators    int    `long:"validators" description:"Number of simulated validators" default:"4"`
+	RPCAddr       string `long:"rpc-addr" description:"Address of the JSON-RPC server" default:""`
+	MempoolSize   int    `long:"mempool-size" description:"Maximum number of pending transactions" default:"10000"`
+	BlockTxLimit  int    `long:"block-tx-limit" description:"Maximum number of mempool transactions per block" default:"100"`
+	Seed          int64  `long:"seed" description:"Seed for deterministic block generation" default:"0"`
+	StoreBackend  string `long:"store-backend" description:"Block store backend" default:"json"`
+	RetainBlocks  uint64 `long:"retain-blocks" description:"Number of most recent blocks kept in the store" default:"0"`
+	Genesis       string `long:"genesis" description:"Genesis file of the chain network" default:""`
 }{}
 
+// Node version, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Flags of the chain parameters, which are defined by the genesis file when the store has one
+var genesisFlags = []string{"genesis-height", "block-rate", "finality-mode", "finality-depth", "validators", "block-tx-limit"}
+
 func main() {
 	root := cobra.Command{
-		Use:   "chain",
-		Short: "CLI for the Dummy Chain",
+		Use:     "chain",
+		Short:   "CLI for the Dummy Chain",
+		Version: version,
 	}
 
 	root.PersistentFlags().Uint64Var(&cliOpts.GenesisHeight, "genesis-height", 1, "Blockchain genesis height")
 	root.PersistentFlags().StringVar(&cliOpts.LogLevel, "log-level", "info", "Logging level")
 	root.PersistentFlags().StringVar(&cliOpts.StoreDir, "store-dir", "./data", "Directory for storing blockchain state")
 	root.PersistentFlags().IntVar(&cliOpts.BlockRate, "block-rate", 1, "Block production rate (per second)")
+	root.PersistentFlags().Uint64Var(&cliOpts.ForkInterval, "fork-interval", 0, "Number of blocks between simulated forks (0 disables forking)")
+	root.PersistentFlags().Uint64Var(&cliOpts.ReorgDepth, "reorg-depth", 1, "Number of blocks abandoned by a simulated reorg")
+	root.PersistentFlags().StringVar(&cliOpts.FinalityMode, "finality-mode", core.FinalityModeDepth, "Finality rule for the last irreversible block (depth, validators)")
+	root.PersistentFlags().Uint64Var(&cliOpts.FinalityDepth, "finality-depth", 1, "Number of blocks until a block becomes irreversible (max confirmation lag in validators mode)")
+	root.PersistentFlags().IntVar(&cliOpts.Validators, "validators", 4, "Number of simulated validators in validators finality mode")
+	root.PersistentFlags().StringVar(&cliOpts.RPCAddr, "rpc-addr", "", "Address of the JSON-RPC server, e.g. localhost:8545 (disabled when empty)")
+	root.PersistentFlags().IntVar(&cliOpts.MempoolSize, "mempool-size", 10000, "Maximum number of pending transactions in the mempool")
+	root.PersistentFlags().IntVar(&cliOpts.BlockTxLimit, "block-tx-limit", 100, "Maximum number of mempool transactions included in a block")
+	root.PersistentFlags().StringVar(&cliOpts.StoreBackend, "store-backend", core.StoreBackendJSON, "Block store backend (json, segments)")
+	root.PersistentFlags().Int64Var(&cliOpts.Seed, "seed", 0, "Seed for deterministic blocks with a simulated clock (0 disables the deterministic mode)")
+	root.PersistentFlags().Uint64Var(&cliOpts.RetainBlocks, "retain-blocks", 0, "Number of most recent blocks kept in the store, older ones are pruned (0 keeps all blocks)")
+	root.PersistentFlags().StringVar(&cliOpts.Genesis, "genesis", "", "Genesis file of the chain network, set on the store by init and checked by start and generate")
 
-	if err := root.ParseFlags(os.Args); err != nil {
-		logrus.Fatal(err)
-	}
+	// Commands may define their own flags, so logging is configured once all flags are parsed
+	root.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		level, err := logrus.ParseLevel(cliOpts.LogLevel)
+		if err != nil {
+			return err
+		}
 
-	level, err := logrus.ParseLevel(cliOpts.LogLevel)
-	if err != nil {
-		logrus.Fatal(err)
+		logrus.SetLevel(level)
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+		return nil
 	}
 
-	logrus.SetLevel(level)
-	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-
 	root.AddCommand(
 		makeInitCommand(),
 		makeResetCommand(),
 		makeStartComand(),
+		makeGenerateCommand(),
+		makeMigrateCommand(),
+		makeReindexCommand(),
+		makePruneCommand(),
+		makeRollbackCommand(),
+		makeExportCommand(),
+		makeImportCommand(),
+		makeProofCommand(),
+		makeVerifyCommand(),
 	)
 
-	root.Execute()
+	if err := root.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
 
 func makeInitCommand() *cobra.Command {
@@ -60,8 +110,37 @@ func makeInitCommand() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logrus.WithField("dir", cliOpts.StoreDir).Info("initializing chain store")
 
-			store := core.NewStore(cliOpts.StoreDir)
-			return store.Initialize()
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			key, err := core.LoadOrCreateProducerKey(cliOpts.StoreDir, cliOpts.Seed)
+			if err != nil {
+				return err
+			}
+
+			logrus.WithField("address", key.Address).Info("using producer key")
+
+			if cliOpts.Genesis == "" {
+				return nil
+			}
+
+			genesis, err := core.ReadGenesisFile(cliOpts.Genesis)
+			if err != nil {
+				return err
+			}
+			if err := core.InitStoreGenesis(store, genesis); err != nil {
+				return err
+			}
+
+			logrus.
+				WithField("chain_id", genesis.ChainID).
+				WithField("hash", genesis.Hash()).
+				Info("using genesis")
+
+			return nil
 		},
 	}
 }
@@ -92,18 +171,18 @@ func makeStartComand() *cobra.Command {
 				return errors.New("block rate option must be greater than 1")
 			}
 
+			node, err := newNode(cmd)
+			if err != nil {
+				return err
+			}
+			defer node.Store().Close()
+
 			// TODO: expose this as a flag too
 			if os.Getenv("DM_ENABLED") == "1" {
-				initDeepMind()
+				initDeepMind(node)
 				defer deepmind.Shutdown()
 			}
 
-			node := core.NewNode(
-				cliOpts.StoreDir,
-				cliOpts.BlockRate,
-				cliOpts.GenesisHeight,
-			)
-
 			if err := node.Initialize(); err != nil {
 				logrus.WithError(err).Fatal("node failed to initialize")
 				return err
@@ -116,8 +195,23 @@ func makeStartComand() *cobra.Command {
 				sig := waitForSignal()
 				logrus.WithField("signal", sig).Info("shutting down")
 				cancel()
+
+				// Blocks wait for a DeepMind output reader once the output buffer is full
+				sig = waitForSignal()
+				logrus.WithField("signal", sig).Fatal("forced shutdown")
 			}()
 
+			if cliOpts.RPCAddr != "" {
+				server := rpc.NewServer(cliOpts.RPCAddr, node)
+
+				go func() {
+					if err := server.Start(ctx); err != nil {
+						logrus.WithError(err).Error("rpc server failed")
+						cancel()
+					}
+				}()
+			}
+
 			if err := node.Start(ctx); err != nil {
 				logrus.WithError(err).Fatal("node terminated with error")
 			} else {
@@ -129,22 +223,639 @@ func makeStartComand() *cobra.Command {
 	}
 }
 
-func initDeepMind() {
+func makeGenerateCommand() *cobra.Command {
+	var from, to uint64
+
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate a range of historical blocks as fast as possible",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cliOpts.BlockRate < 1 {
+				return errors.New("block rate option must be greater than 1")
+			}
+			if to < from {
+				return fmt.Errorf("--to height %d is below --from height %d", to, from)
+			}
+
+			node, err := newNode(cmd)
+			if err != nil {
+				return err
+			}
+			defer node.Store().Close()
+
+			if os.Getenv("DM_ENABLED") == "1" {
+				initDeepMind(node)
+				defer deepmind.Shutdown()
+			}
+
+			if err := node.Initialize(); err != nil {
+				return err
+			}
+
+			// Blocks are spaced exactly one block time apart. A new chain ends at the
+			// current time, so the node can continue from the generated history.
+			if cliOpts.Seed == 0 {
+				blockTime := time.Second / time.Duration(cliOpts.BlockRate)
+				genesisTime := time.Now().Add(-time.Duration(to-from+1) * blockTime)
+
+				// A network genesis fixes the time of the first block instead
+				if genesis := node.Genesis(); genesis != nil {
+					blockTime = time.Duration(genesis.BlockTime)
+					genesisTime = genesis.GenesisTime
+				}
+
+				node.UseClock(core.NewSimulatedClock(genesisTime, blockTime))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				sig := waitForSignal()
+				logrus.WithField("signal", sig).Info("shutting down")
+				cancel()
+
+				// Blocks wait for a DeepMind output reader once the output buffer is full
+				sig = waitForSignal()
+				logrus.WithField("signal", sig).Fatal("forced shutdown")
+			}()
+
+			return node.Generate(ctx, from, to)
+		},
+	}
+
+	cmd.Flags().Uint64Var(&from, "from", 0, "First block height, must follow the store tip (genesis height for an empty store)")
+	cmd.Flags().Uint64Var(&to, "to", 0, "Last block height")
+	cmd.MarkFlagRequired("from")
+	cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+func makeMigrateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate the store directory to the backend set with --store-backend",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := core.MigrateStore(cliOpts.StoreDir, cliOpts.StoreBackend); err != nil {
+				return err
+			}
+
+			logrus.
+				WithField("dir", cliOpts.StoreDir).
+				WithField("backend", cliOpts.StoreBackend).
+				Info("store migrated")
+
+			return nil
+		},
+	}
+}
+
+func makeReindexCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "reindex",
+		Short: "Rebuild block, transaction and address indexes from the local store",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logrus.WithField("dir", cliOpts.StoreDir).Info("removing store index")
+
+			if err := core.RemoveIndex(cliOpts.StoreDir); err != nil {
+				return err
+			}
+
+			// Opening the store indexes all blocks again
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			logrus.
+				WithField("start", store.StartHeight()).
+				WithField("tip", store.TipHeight()).
+				Info("store reindexed")
+
+			return nil
+		},
+	}
+}
+
+func makePruneCommand() *cobra.Command {
+	var before uint64
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old blocks from the local store",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (before == 0) == (cliOpts.RetainBlocks == 0) {
+				return errors.New("either --before or --retain-blocks is required")
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			cutoff := before
+			if cliOpts.RetainBlocks > 0 {
+				cutoff = core.RetentionCutoff(store.TipHeight(), store.LibHeight(), cliOpts.RetainBlocks)
+			}
+			if cutoff > store.LibHeight() {
+				return fmt.Errorf("cant prune above the last irreversible block %d", store.LibHeight())
+			}
+
+			previous := store.StartHeight()
+			if cutoff <= previous {
+				logrus.WithField("start", previous).Info("nothing to prune")
+				return nil
+			}
+
+			if err := store.Prune(cutoff); err != nil {
+				return err
+			}
+
+			// The segments backend only removes whole segments
+			if store.StartHeight() == previous {
+				logrus.WithField("start", previous).WithField("cutoff", cutoff).Info("no blocks could be removed below the cutoff")
+				return nil
+			}
+
+			logrus.
+				WithField("pruned", store.PrunedHeight()).
+				WithField("start", store.StartHeight()).
+				WithField("removed", store.StartHeight()-previous).
+				Info("blocks pruned")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().Uint64Var(&before, "before", 0, "Remove all blocks below this height")
+
+	return cmd
+}
+
+func makeRollbackCommand() *cobra.Command {
+	var (
+		to    uint64
+		force bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Remove all blocks above given height, the next start rebuilds the chain from there",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			rollback, err := core.RollbackStore(store, to, force)
+			if err != nil {
+				return err
+			}
+
+			logrus.
+				WithField("height", rollback.Height).
+				WithField("hash", rollback.Hash).
+				WithField("removed", rollback.FromHeight-rollback.Height).
+				Info("chain rolled back")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().Uint64Var(&to, "to", 0, "Height of the new chain tip")
+	cmd.Flags().BoolVar(&force, "force", false, "Allow removing irreversible blocks")
+	cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+func makeExportCommand() *cobra.Command {
+	var (
+		from, to       uint64
+		format, output string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export a range of stored blocks as JSONL, CSV or length-delimited protobuf",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			if store.TipHeight() == 0 {
+				return errors.New("store has no blocks")
+			}
+			if from == 0 {
+				from = store.StartHeight()
+			}
+			if to == 0 {
+				to = store.TipHeight()
+			}
+			if from <= store.PrunedHeight() {
+				return &core.PrunedError{Height: from, StartHeight: store.StartHeight()}
+			}
+			if from < store.StartHeight() || to > store.TipHeight() || to < from {
+				return fmt.Errorf("range %d to %d is outside of the stored blocks %d to %d", from, to, store.StartHeight(), store.TipHeight())
+			}
+
+			writer, err := export.NewWriter(format, output)
+			if err != nil {
+				return err
+			}
+
+			for height := from; height <= to; height++ {
+				block, err := store.ReadBlock(height)
+				if err != nil {
+					writer.Close()
+					return fmt.Errorf("cant read block %d: %v", height, err)
+				}
+
+				if err := writer.WriteBlock(block); err != nil {
+					writer.Close()
+					return err
+				}
+			}
+
+			if err := writer.Close(); err != nil {
+				return err
+			}
+
+			logrus.
+				WithField("from", from).
+				WithField("to", to).
+				WithField("format", format).
+				Info("blocks exported")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().Uint64Var(&from, "from", 0, "First block height (default store start height)")
+	cmd.Flags().Uint64Var(&to, "to", 0, "Last block height (default store tip height)")
+	cmd.Flags().StringVar(&format, "format", export.FormatJSONL, "Export format (jsonl, csv, pb)")
+	cmd.Flags().StringVar(&output, "output", "-", "Output file, or directory for the csv format")
+
+	return cmd
+}
+
+func makeImportCommand() *cobra.Command {
+	var format, input string
+
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import blocks exported with the export command on top of the local store",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reader, err := export.NewReader(format, input)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			producer, err := storeProducer()
+			if err != nil {
+				return err
+			}
+
+			importer, err := core.NewImporter(store, producer)
+			if err != nil {
+				return err
+			}
+
+			count := 0
+			for {
+				block, err := reader.ReadBlock()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("cant read block after %d imported blocks: %v", count, err)
+				}
+
+				if err := importer.Import(block); err != nil {
+					return err
+				}
+				count++
+			}
+
+			if count == 0 {
+				return errors.New("no blocks to import")
+			}
+
+			logrus.
+				WithField("count", count).
+				WithField("tip", importer.Tip().Height).
+				Info("blocks imported")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", export.FormatJSONL, "Import format (jsonl, csv, pb)")
+	cmd.Flags().StringVar(&input, "input", "-", "Input file, or directory for the csv format")
+
+	return cmd
+}
+
+func makeProofCommand() *cobra.Command {
+	var height uint64
+
+	cmd := &cobra.Command{
+		Use:   "proof <tx-hash>",
+		Short: "Print merkle inclusion proof for a transaction",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			block, err := store.ReadBlock(height)
+			if err != nil {
+				return err
+			}
+
+			proof, err := core.TxProof(block, args[0])
+			if err != nil {
+				return err
+			}
+
+			if proof.Root != block.TxRoot {
+				return fmt.Errorf("computed root %s does not match block root %s", proof.Root, block.TxRoot)
+			}
+
+			if !proof.Verify() {
+				return errors.New("proof verification failed")
+			}
+
+			data, err := json.MarshalIndent(proof, "", "  ")
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(string(data))
+			return nil
+		},
+	}
+
+	cmd.Flags().Uint64Var(&height, "height", 0, "Height of the block containing the transaction")
+	cmd.MarkFlagRequired("height")
+
+	return cmd
+}
+
+func makeVerifyCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "Check integrity of all blocks in the local store and print a JSON report",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// The store is inspected as it is, a repair would hide the damage
+			store, err := core.OpenStoreReadOnly(cliOpts.StoreDir)
+			if err != nil {
+				return err
+			}
+			if err := store.Initialize(); err != nil {
+				return err
+			}
+			defer store.Close()
+
+			producer, err := storeProducer()
+			if err != nil {
+				return err
+			}
+
+			report := core.VerifyStore(store, producer)
+
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+
+			if !report.Valid {
+				return fmt.Errorf("found %d problems in blocks %d to %d", len(report.Problems), report.StartHeight, report.TipHeight)
+			}
+
+			logrus.
+				WithField("start", report.StartHeight).
+				WithField("tip", report.TipHeight).
+				Info("all blocks are valid")
+
+			return nil
+		},
+	}
+}
+
+func newNode(cmd *cobra.Command) (*core.Node, error) {
+	genesis, err := loadGenesis()
+	if err != nil {
+		return nil, err
+	}
+
+	blockTime := time.Second / time.Duration(cliOpts.BlockRate)
+	genesisHeight := cliOpts.GenesisHeight
+	finalityConfig := core.FinalityConfig{
+		Mode:       cliOpts.FinalityMode,
+		Depth:      cliOpts.FinalityDepth,
+		Validators: cliOpts.Validators,
+	}
+	blockTxLimit := cliOpts.BlockTxLimit
+
+	if genesis != nil {
+		for _, name := range genesisFlags {
+			if cmd.Flags().Changed(name) {
+				return nil, fmt.Errorf("--%s can't be used with a store initialized from a genesis file", name)
+			}
+		}
+
+		blockTime = time.Duration(genesis.BlockTime)
+		genesisHeight = genesis.GenesisHeight
+		finalityConfig = genesis.FinalityConfig()
+		blockTxLimit = genesis.Params.Mempool.BlockTxLimit
+	}
+
+	store, err := core.NewStore(cliOpts.StoreBackend, cliOpts.StoreDir)
+	if err != nil {
+		return nil, err
+	}
+
+	node := core.NewNode(
+		store,
+		blockTime,
+		genesisHeight,
+		core.ForkConfig{
+			Interval: cliOpts.ForkInterval,
+			Depth:    cliOpts.ReorgDepth,
+		},
+		finalityConfig,
+		core.MempoolConfig{
+			Size:       cliOpts.MempoolSize,
+			BlockLimit: blockTxLimit,
+		},
+		cliOpts.Seed,
+	)
+	node.RetainBlocks(cliOpts.RetainBlocks)
+
+	if genesis != nil {
+		logrus.
+			WithField("chain_id", genesis.ChainID).
+			WithField("hash", genesis.Hash()).
+			Info("using genesis")
+
+		node.UseGenesis(genesis)
+	}
+
+	return node, nil
+}
+
+// loadGenesis returns the genesis the store was initialized with, nil for a store
+// configured with the flags only. A genesis file given with --genesis must match it.
+func loadGenesis() (*core.Genesis, error) {
+	genesis, err := core.ReadStoreGenesis(cliOpts.StoreDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if cliOpts.Genesis == "" {
+		return genesis, nil
+	}
+
+	expected, err := core.ReadGenesisFile(cliOpts.Genesis)
+	if err != nil {
+		return nil, err
+	}
+
+	if genesis == nil {
+		return nil, fmt.Errorf("store %s is not initialized with a genesis file, run init with --genesis first", cliOpts.StoreDir)
+	}
+	if genesis.Hash() != expected.Hash() {
+		return nil, fmt.Errorf("store %s was built from genesis %s of chain %q, not from %s", cliOpts.StoreDir, genesis.Hash(), genesis.ChainID, cliOpts.Genesis)
+	}
+
+	return genesis, nil
+}
+
+// openStore initializes the store for commands working on the stored chain only
+func openStore() (core.Store, error) {
+	store, err := core.NewStore(cliOpts.StoreBackend, cliOpts.StoreDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, store.Initialize()
+}
+
+// storeProducer returns the public key of the store producer key, which is derived
+// from the seed when the store has none yet. Without both, it returns nil.
+func storeProducer() (ed25519.PublicKey, error) {
+	key, err := core.LoadProducerKey(cliOpts.StoreDir, cliOpts.Seed)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		logrus.Warn("store has no producer key, blocks must be signed by the producer of the first block")
+		return nil, nil
+	}
+	return key.PublicKey, nil
+}
+
+func initDeepMind(node *core.Node) {
+	if dmMode := os.Getenv("DM_MODE"); dmMode != "" {
+		if err := deepmind.SetMode(dmMode); err != nil {
+			logrus.WithError(err).Fatal("invalid DM mode")
+		}
+	}
+
+	// What the node does when a block can't be written to the output
+	emitConfig := core.EmitConfig{
+		Policy:  core.EmitPolicyHalt,
+		Retries: dmEnvInt("DM_RETRY_LIMIT", 5),
+	}
+	if policy := os.Getenv("DM_FAILURE_POLICY"); policy != "" {
+		emitConfig.Policy = policy
+	}
+	if err := emitConfig.Validate(); err != nil {
+		logrus.WithError(err).Fatal("invalid DM failure policy")
+	}
+	node.UseEmitConfig(emitConfig)
+
 	// A global flag to enable instrumentation
 	dmOutput := os.Getenv("DM_OUTPUT")
 
-	switch dmOutput {
-	case "", "stdout", "STDOUT":
-		deepmind.Enable(os.Stdout)
-	case "stderr", "STDERR":
-		deepmind.Enable(os.Stderr)
+	// Output kept in memory while a socket or pipe reader is away
+	bufferSize := dmEnvInt("DM_BUFFER_SIZE", deepmind.DefaultBufferSize)
+
+	rotation := deepmind.RotationConfig{
+		MaxSize:   int64(dmEnvInt("DM_ROTATE_SIZE", 0)),
+		MaxBlocks: uint64(dmEnvInt("DM_ROTATE_BLOCKS", 0)),
+		Retain:    dmEnvInt("DM_RETAIN_FILES", 0),
+	}
+
+	var dmWriter io.WriteCloser
+
+	switch {
+	case dmOutput == "", dmOutput == "stdout", dmOutput == "STDOUT":
+		dmWriter = os.Stdout
+	case dmOutput == "stderr", dmOutput == "STDERR":
+		dmWriter = os.Stderr
+	case deepmind.IsSocketAddr(dmOutput):
+		socket, err := deepmind.NewSocketWriter(dmOutput, bufferSize)
+		if err != nil {
+			logrus.WithError(err).Fatal("invalid DM output socket")
+		}
+		dmWriter = socket
+	case isNamedPipe(dmOutput):
+		dmWriter = deepmind.NewPipeWriter(dmOutput, bufferSize)
+	case rotation.Enabled():
+		dmFile, err := deepmind.NewRotatingFile(dmOutput, rotation)
+		if err != nil {
+			logrus.WithError(err).Fatal("cant open DM output file")
+		}
+		dmWriter = dmFile
 	default:
 		dmFile, err := os.OpenFile(dmOutput, os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0666)
 		if err != nil {
 			logrus.WithError(err).Fatal("cant open DM output file")
 		}
-		deepmind.Enable(dmFile)
+		dmWriter = dmFile
+	}
+
+	if err := deepmind.Enable(dmWriter, node.ChainID(), version); err != nil {
+		logrus.WithError(err).Fatal("cant start DM output")
+	}
+}
+
+// dmEnvInt returns the value of a numeric DM variable, which must not be negative
+func dmEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		logrus.WithField("value", value).Fatalf("invalid %s value", name)
 	}
+	return number
+}
+
+func isNamedPipe(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
 }
 
 func waitForSignal() os.Signal {
@@ -0,0 +1,142 @@
+package pbcodec
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// FromBlock converts the chain block into its protobuf message
+func FromBlock(block *types.Block) *Block {
+	return FromTracedBlock(block, nil)
+}
+
+// FromTracedBlock converts the chain block into its protobuf message, along with
+// the balance changes made by each transaction when there are any. Ordinals number
+// the beginning of each transaction, its balance changes, its events and its end
+// in execution order.
+func FromTracedBlock(block *types.Block, balanceChanges [][]types.BalanceChange) *Block {
+	newBlock := &Block{
+		Height:       block.Height,
+		Hash:         block.Hash,
+		PrevHash:     block.PrevHash,
+		LibNum:       block.LibNum,
+		Transactions: make([]*Transaction, len(block.Transactions)),
+		Timestamp:    uint64(block.Timestamp.UnixNano()),
+		TxRoot:       block.TxRoot,
+		Producer:     block.Producer,
+		PublicKey:    block.PublicKey,
+		Signature:    block.Signature,
+	}
+
+	var ordinal uint64
+
+	for idx, tx := range block.Transactions {
+		beginOrdinal := ordinal
+		ordinal++
+
+		var changes []*BalanceChange
+		if idx < len(balanceChanges) {
+			changes = make([]*BalanceChange, len(balanceChanges[idx]))
+
+			for idxCh, change := range balanceChanges[idx] {
+				changes[idxCh] = &BalanceChange{
+					Address:  change.Address,
+					OldValue: &BigInt{Bytes: change.OldValue.Bytes()},
+					NewValue: &BigInt{Bytes: change.NewValue.Bytes()},
+					Reason:   change.Reason,
+					Ordinal:  ordinal,
+				}
+				ordinal++
+			}
+		}
+
+		events := make([]*Event, len(tx.Events))
+
+		for idxEv, ev := range tx.Events {
+			events[idxEv] = &Event{
+				Type:    ev.Type,
+				Ordinal: ordinal,
+			}
+			ordinal++
+
+			for _, attr := range ev.Attributes {
+				events[idxEv].Attributes = append(events[idxEv].Attributes, &Attribute{
+					Key:   attr.Key,
+					Value: attr.Value,
+				})
+			}
+		}
+
+		newBlock.Transactions[idx] = &Transaction{
+			Type:     tx.Type,
+			Hash:     tx.Hash,
+			Sender:   tx.Sender,
+			Receiver: tx.Receiver,
+			Amount: &BigInt{
+				Bytes: tx.Amount.Bytes(),
+			},
+			Fee: &BigInt{
+				Bytes: tx.Fee.Bytes(),
+			},
+			Nonce:          tx.Nonce,
+			Success:        tx.Success,
+			Events:         events,
+			BeginOrdinal:   beginOrdinal,
+			EndOrdinal:     ordinal,
+			BalanceChanges: changes,
+		}
+		ordinal++
+	}
+
+	return newBlock
+}
+
+// ToBlock converts the protobuf message back into a chain block
+func (b *Block) ToBlock() *types.Block {
+	block := &types.Block{
+		Height:       b.Height,
+		Hash:         b.Hash,
+		PrevHash:     b.PrevHash,
+		LibNum:       b.LibNum,
+		Timestamp:    time.Unix(0, int64(b.Timestamp)).UTC(),
+		TxRoot:       b.TxRoot,
+		Producer:     b.Producer,
+		PublicKey:    b.PublicKey,
+		Signature:    b.Signature,
+		Transactions: make([]types.Transaction, len(b.Transactions)),
+	}
+
+	for idx, tx := range b.Transactions {
+		events := make([]types.Event, len(tx.Events))
+
+		for idxEv, ev := range tx.Events {
+			events[idxEv] = types.Event{
+				Type:       ev.Type,
+				Attributes: make([]types.Attribute, len(ev.Attributes)),
+			}
+
+			for idxAttr, attr := range ev.Attributes {
+				events[idxEv].Attributes[idxAttr] = types.Attribute{
+					Key:   attr.Key,
+					Value: attr.Value,
+				}
+			}
+		}
+
+		block.Transactions[idx] = types.Transaction{
+			Type:     tx.Type,
+			Hash:     tx.Hash,
+			Sender:   tx.Sender,
+			Receiver: tx.Receiver,
+			Amount:   new(big.Int).SetBytes(tx.Amount.GetBytes()),
+			Fee:      new(big.Int).SetBytes(tx.Fee.GetBytes()),
+			Nonce:    tx.Nonce,
+			Success:  tx.Success,
+			Events:   events,
+		}
+	}
+
+	return block
+}
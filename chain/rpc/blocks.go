@@ -0,0 +1,111 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/core"
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// Maximum number of blocks returned by a single range request
+const maxBlockRange = 100
+
+type getBlockParams struct {
+	Height uint64 `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+type getBlockRangeParams struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+type tipResult struct {
+	Height       uint64 `json:"height"`
+	Hash         string `json:"hash"`
+	LibHeight    uint64 `json:"lib_height"`
+	StartHeight  uint64 `json:"start_height"`
+	PrunedHeight uint64 `json:"pruned_height"`
+	ChainID      string `json:"chain_id,omitempty"`
+	GenesisHash  string `json:"genesis_hash,omitempty"`
+}
+
+// getTip returns the current head of the stored chain
+func (s *Server) getTip(params json.RawMessage) (interface{}, error) {
+	store := s.node.Store()
+
+	tip := store.TipHeight()
+	if tip == 0 {
+		return nil, errors.New("chain has no blocks yet")
+	}
+
+	block, err := store.ReadBlock(tip)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &tipResult{
+		Height:       block.Height,
+		Hash:         block.Hash,
+		LibHeight:    block.LibNum,
+		StartHeight:  store.StartHeight(),
+		PrunedHeight: store.PrunedHeight(),
+	}
+
+	if genesis := s.node.Genesis(); genesis != nil {
+		result.ChainID = genesis.ChainID
+		result.GenesisHash = genesis.Hash()
+	}
+
+	return result, nil
+}
+
+// getBlock returns a block by height or hash
+func (s *Server) getBlock(params json.RawMessage) (interface{}, error) {
+	p := getBlockParams{}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.Hash != "":
+		return s.node.Store().ReadBlockByHash(p.Hash)
+	case p.Height > 0:
+		return s.node.Store().ReadBlock(p.Height)
+	default:
+		return nil, invalidParams(errors.New("block height or hash is required"))
+	}
+}
+
+// getBlockRange returns all blocks in the inclusive height range
+func (s *Server) getBlockRange(params json.RawMessage) (interface{}, error) {
+	p := getBlockRangeParams{}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	if p.From == 0 || p.To < p.From {
+		return nil, invalidParams(errors.New("invalid block range"))
+	}
+	if p.To-p.From+1 > maxBlockRange {
+		return nil, invalidParams(fmt.Errorf("block range must not exceed %d blocks", maxBlockRange))
+	}
+
+	store := s.node.Store()
+	if p.From <= store.PrunedHeight() {
+		return nil, &core.PrunedError{Height: p.From, StartHeight: store.StartHeight()}
+	}
+
+	blocks := []*types.Block{}
+	for height := p.From; height <= p.To; height++ {
+		block, err := store.ReadBlock(height)
+		if err != nil {
+			return nil, fmt.Errorf("cant read block %d: %v", height, err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,178 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/core"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeServerError    = -32000
+)
+
+type request struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a JSON-RPC error object
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func invalidParams(err error) *Error {
+	return &Error{Code: codeInvalidParams, Message: err.Error()}
+}
+
+type handlerFunc func(params json.RawMessage) (interface{}, error)
+
+// Server serves the node JSON-RPC API over HTTP and websockets
+type Server struct {
+	addr     string
+	node     *core.Node
+	handlers map[string]handlerFunc
+}
+
+func NewServer(addr string, node *core.Node) *Server {
+	server := &Server{
+		addr: addr,
+		node: node,
+	}
+
+	server.handlers = map[string]handlerFunc{
+		"submit_transaction":       server.submitTransaction,
+		"get_account":              server.getAccount,
+		"get_transaction":          server.getTransaction,
+		"get_address_transactions": server.getAddressTransactions,
+		"get_tip":                  server.getTip,
+		"get_block":                server.getBlock,
+		"get_block_range":          server.getBlockRange,
+	}
+
+	return server
+}
+
+// Start serves requests until the context is cancelled
+func (s *Server) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleHTTP)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocket(ctx, w, r)
+	})
+
+	httpServer := &http.Server{
+		Addr:    s.addr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	logrus.WithField("addr", s.addr).Info("starting rpc server")
+
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	logrus.Info("rpc server stopped")
+	return nil
+}
+
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	req := request{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeResponse(w, response{Error: &Error{Code: codeParseError, Message: err.Error()}})
+		return
+	}
+
+	s.writeResponse(w, s.call(req))
+}
+
+func (s *Server) call(req request) response {
+	resp := response{ID: req.ID}
+
+	if req.Version != "2.0" || req.Method == "" {
+		resp.Error = &Error{Code: codeInvalidRequest, Message: "invalid request"}
+		return resp
+	}
+
+	handler, ok := s.handlers[req.Method]
+	if !ok {
+		resp.Error = &Error{Code: codeMethodNotFound, Message: "method not found: " + req.Method}
+		return resp
+	}
+
+	result, err := handler(req.Params)
+	if err != nil {
+		rpcErr := &Error{}
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: codeServerError, Message: err.Error()}
+		}
+
+		logrus.WithField("method", req.Method).WithError(err).Debug("rpc request failed")
+		resp.Error = rpcErr
+		return resp
+	}
+
+	resp.Result = result
+	return resp
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, resp response) {
+	resp.Version = "2.0"
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logrus.WithError(err).Error("cant write rpc response")
+	}
+}
+
+// decodeParams reads named parameters of the request
+func decodeParams(params json.RawMessage, dst interface{}) error {
+	if len(params) == 0 {
+		return invalidParams(errors.New("missing params"))
+	}
+
+	if err := json.Unmarshal(params, dst); err != nil {
+		return invalidParams(err)
+	}
+
+	return nil
+}
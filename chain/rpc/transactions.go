@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// Maximum number of transactions returned by a single address request
+const maxAddressTransactions = 100
+
+type submitTransactionResult struct {
+	Hash string `json:"hash"`
+}
+
+type getTransactionParams struct {
+	Hash string `json:"hash"`
+}
+
+type getAddressTransactionsParams struct {
+	Address string `json:"address"`
+	Before  uint64 `json:"before"`
+	Limit   int    `json:"limit"`
+}
+
+type getAccountParams struct {
+	Address string `json:"address"`
+}
+
+// submitTransaction adds a transaction to the mempool
+func (s *Server) submitTransaction(params json.RawMessage) (interface{}, error) {
+	tx := types.Transaction{}
+	if err := decodeParams(params, &tx); err != nil {
+		return nil, err
+	}
+
+	hash, err := s.node.SubmitTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return submitTransactionResult{Hash: hash}, nil
+}
+
+// getAccount returns the balance and nonce of an account at the chain head
+func (s *Server) getAccount(params json.RawMessage) (interface{}, error) {
+	p := getAccountParams{}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Address == "" {
+		return nil, invalidParams(errors.New("address is required"))
+	}
+
+	account := s.node.Account(p.Address)
+	return &account, nil
+}
+
+// getTransaction returns a transaction by hash along with its block location
+func (s *Server) getTransaction(params json.RawMessage) (interface{}, error) {
+	p := getTransactionParams{}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Hash == "" {
+		return nil, invalidParams(errors.New("transaction hash is required"))
+	}
+
+	return s.node.Store().ReadTransaction(p.Hash)
+}
+
+// getAddressTransactions returns transactions sent or received by an address, the most recent first
+func (s *Server) getAddressTransactions(params json.RawMessage) (interface{}, error) {
+	p := getAddressTransactionsParams{}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Address == "" {
+		return nil, invalidParams(errors.New("address is required"))
+	}
+	if p.Limit == 0 {
+		p.Limit = maxAddressTransactions
+	}
+	if p.Limit < 0 || p.Limit > maxAddressTransactions {
+		return nil, invalidParams(fmt.Errorf("limit must be between 1 and %d", maxAddressTransactions))
+	}
+
+	return s.node.Store().ReadAddressTransactions(p.Address, p.Before, p.Limit)
+}
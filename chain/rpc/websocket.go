@@ -0,0 +1,353 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	"github.com/figment-networks/graph-instrumentation-example/chain/core"
+	"github.com/figment-networks/graph-instrumentation-example/chain/types"
+)
+
+// Subscription types
+const (
+	subscribeNewHeads     = "new_heads"
+	subscribeTransactions = "transactions"
+	subscribeEvents       = "events"
+)
+
+const (
+	// Number of blocks buffered for a connection before it's considered too slow
+	wsBlockBuffer = 100
+
+	wsWriteTimeout = 10 * time.Second
+	wsMaxMessage   = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	// The node is a development tool, so connections are accepted from any origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type subscribeParams struct {
+	Type string `json:"type"`
+
+	// Transaction filters, an address matches either the sender or the receiver
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	Address  string `json:"address"`
+
+	// Event filters
+	EventType  string            `json:"event_type"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type unsubscribeParams struct {
+	Subscription string `json:"subscription"`
+}
+
+type notification struct {
+	Version string             `json:"jsonrpc"`
+	Method  string             `json:"method"`
+	Params  notificationParams `json:"params"`
+}
+
+type notificationParams struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result"`
+}
+
+type headResult struct {
+	Height          uint64    `json:"height"`
+	Hash            string    `json:"hash"`
+	PrevHash        string    `json:"prev_hash"`
+	LibNum          uint64    `json:"lib_num"`
+	Timestamp       time.Time `json:"timestamp"`
+	TxRoot          string    `json:"tx_root"`
+	Producer        string    `json:"producer"`
+	NumTransactions int       `json:"num_transactions"`
+}
+
+type eventResult struct {
+	BlockHeight uint64      `json:"block_height"`
+	BlockHash   string      `json:"block_hash"`
+	TxHash      string      `json:"tx_hash"`
+	TxIndex     int         `json:"tx_index"`
+	EventIndex  int         `json:"event_index"`
+	Event       types.Event `json:"event"`
+}
+
+// wsConn is a single websocket client with its subscriptions
+type wsConn struct {
+	conn   *websocket.Conn
+	out    chan interface{}
+	closed chan struct{}
+
+	lock   sync.Mutex
+	subs   map[uint64]subscribeParams
+	nextID uint64
+}
+
+// handleWebSocket serves block and event subscriptions over a websocket connection
+func (s *Server) handleWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.WithError(err).Debug("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	logrus.WithField("remote", r.RemoteAddr).Debug("websocket client connected")
+	defer logrus.WithField("remote", r.RemoteAddr).Debug("websocket client disconnected")
+
+	blocks, cancel := s.node.SubscribeBlocks(wsBlockBuffer)
+	defer cancel()
+
+	c := &wsConn{
+		conn:   conn,
+		out:    make(chan interface{}, wsBlockBuffer),
+		closed: make(chan struct{}),
+		subs:   map[uint64]subscribeParams{},
+	}
+	defer close(c.closed)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.readLoop(s)
+	}()
+
+	for {
+		select {
+		case msg := <-c.out:
+			if err := c.write(msg); err != nil {
+				return
+			}
+		case block, ok := <-blocks:
+			if !ok {
+				return
+			}
+			for _, msg := range c.notifications(block) {
+				if err := c.write(msg); err != nil {
+					return
+				}
+			}
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *wsConn) readLoop(s *Server) {
+	c.conn.SetReadLimit(wsMaxMessage)
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		req := request{}
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.send(response{Version: "2.0", Error: &Error{Code: codeParseError, Message: err.Error()}})
+			continue
+		}
+
+		resp := response{Version: "2.0", ID: req.ID}
+
+		var result interface{}
+		switch req.Method {
+		case "subscribe":
+			result, err = c.subscribe(req.Params)
+		case "unsubscribe":
+			result, err = c.unsubscribe(req.Params)
+		default:
+			// Regular methods are available over the websocket too
+			resp = s.call(req)
+			resp.Version = "2.0"
+		}
+
+		if err != nil {
+			rpcErr := &Error{}
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &Error{Code: codeServerError, Message: err.Error()}
+			}
+			resp.Error = rpcErr
+		} else if result != nil {
+			resp.Result = result
+		}
+
+		c.send(resp)
+	}
+}
+
+// send queues a message for the writer, unless the connection is already closed
+func (c *wsConn) send(msg interface{}) {
+	select {
+	case c.out <- msg:
+	case <-c.closed:
+	}
+}
+
+func (c *wsConn) subscribe(params json.RawMessage) (interface{}, error) {
+	p := subscribeParams{}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	switch p.Type {
+	case subscribeNewHeads, subscribeTransactions, subscribeEvents:
+	default:
+		return nil, invalidParams(fmt.Errorf("unsupported subscription type: %q", p.Type))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.nextID++
+	c.subs[c.nextID] = p
+
+	return subscriptionID(c.nextID), nil
+}
+
+func (c *wsConn) unsubscribe(params json.RawMessage) (interface{}, error) {
+	p := unsubscribeParams{}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for id := range c.subs {
+		if subscriptionID(id) == p.Subscription {
+			delete(c.subs, id)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// notifications returns messages for all subscriptions matching the block
+func (c *wsConn) notifications(block *types.Block) []notification {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := []notification{}
+	notify := func(id uint64, data interface{}) {
+		result = append(result, notification{
+			Version: "2.0",
+			Method:  "subscription",
+			Params:  notificationParams{Subscription: subscriptionID(id), Result: data},
+		})
+	}
+
+	// Deliver notifications in the order subscriptions were created
+	ids := make([]uint64, 0, len(c.subs))
+	for id := range c.subs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		sub := c.subs[id]
+
+		switch sub.Type {
+		case subscribeNewHeads:
+			notify(id, &headResult{
+				Height:          block.Height,
+				Hash:            block.Hash,
+				PrevHash:        block.PrevHash,
+				LibNum:          block.LibNum,
+				Timestamp:       block.Timestamp,
+				TxRoot:          block.TxRoot,
+				Producer:        block.Producer,
+				NumTransactions: len(block.Transactions),
+			})
+
+		case subscribeTransactions:
+			for idx, tx := range block.Transactions {
+				if sub.matchTransaction(&tx) {
+					notify(id, &core.TransactionRecord{
+						BlockHeight: block.Height,
+						BlockHash:   block.Hash,
+						Index:       idx,
+						Transaction: tx,
+					})
+				}
+			}
+
+		case subscribeEvents:
+			for txIdx, tx := range block.Transactions {
+				for evIdx, ev := range tx.Events {
+					if sub.matchEvent(&ev) {
+						notify(id, &eventResult{
+							BlockHeight: block.Height,
+							BlockHash:   block.Hash,
+							TxHash:      tx.Hash,
+							TxIndex:     txIdx,
+							EventIndex:  evIdx,
+							Event:       ev,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func (c *wsConn) write(msg interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(msg)
+}
+
+func subscriptionID(id uint64) string {
+	return fmt.Sprintf("0x%x", id)
+}
+
+func (p subscribeParams) matchTransaction(tx *types.Transaction) bool {
+	if p.Sender != "" && tx.Sender != p.Sender {
+		return false
+	}
+	if p.Receiver != "" && tx.Receiver != p.Receiver {
+		return false
+	}
+	if p.Address != "" && tx.Sender != p.Address && tx.Receiver != p.Address {
+		return false
+	}
+	return true
+}
+
+func (p subscribeParams) matchEvent(ev *types.Event) bool {
+	if p.EventType != "" && ev.Type != p.EventType {
+		return false
+	}
+
+	for key, value := range p.Attributes {
+		found := false
+		for _, attr := range ev.Attributes {
+			if attr.Key == key && attr.Value == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
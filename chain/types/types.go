@@ -9,7 +9,12 @@ type Block struct {
 	Height       uint64        `json:"height"`
 	Hash         string        `json:"hash"`
 	PrevHash     string        `json:"prev_hash"`
+	LibNum       uint64        `json:"lib_num"`
 	Timestamp    time.Time     `json:"timestamp"`
+	TxRoot       string        `json:"tx_root"`
+	Producer     string        `json:"producer"`
+	PublicKey    string        `json:"public_key"`
+	Signature    string        `json:"signature"`
 	Transactions []Transaction `json:"transactions"`
 }
 
@@ -20,6 +25,7 @@ type Transaction struct {
 	Receiver string   `json:"receiver"`
 	Amount   *big.Int `json:"amount"`
 	Fee      *big.Int `json:"fee"`
+	Nonce    uint64   `json:"nonce"`
 	Success  bool     `json:"success"`
 	Events   []Event  `json:"events"`
 }
@@ -33,3 +39,20 @@ type Attribute struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
 }
+
+const (
+	// The sender pays the transaction fee, which is burned
+	BalanceChangeReasonFee = "fee"
+
+	// The sender transfers the amount to the receiver
+	BalanceChangeReasonTransferSend    = "transfer_send"
+	BalanceChangeReasonTransferReceive = "transfer_receive"
+)
+
+// BalanceChange is a single update of an account balance made by a transaction
+type BalanceChange struct {
+	Address  string   `json:"address"`
+	OldValue *big.Int `json:"old_value"`
+	NewValue *big.Int `json:"new_value"`
+	Reason   string   `json:"reason"`
+}
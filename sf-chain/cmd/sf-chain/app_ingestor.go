@@ -28,18 +28,22 @@ import (
 )
 
 const (
-	modeLogs  = "logs"
-	modeStdin = "stdin"
+	modeLogs   = "logs"
+	modeStdin  = "stdin"
+	modeSocket = "socket"
+	modePipe   = "pipe"
 )
 
 func init() {
 	registerFlags := func(cmd *cobra.Command) error {
 		flags := cmd.Flags()
 
-		flags.String("ingestor-mode", modeStdin, "mode of operation")
+		flags.String("ingestor-mode", modeStdin, "mode of operation (stdin, logs, socket, pipe)")
+		flags.String("ingestor-listen-addr", "", "address the node connects to in socket mode, unix:///path or tcp://host:port")
+		flags.String("ingestor-pipe-path", "", "named pipe the node writes to in pipe mode, created when missing")
 		flags.String("ingestor-logs-dir", "", "directory where instrumentation logs are stored")
-		flags.String("ingestor-logs-pattern", ".log", "pattern of the log files")
-		flags.Bool("ingestor-logs-watch", true, "exit when all matched files are processed")
+		flags.String("ingestor-logs-pattern", ".log", "suffix of the rotated log files, which are removed once read")
+		flags.Bool("ingestor-logs-watch", true, "wait for new log files, otherwise exit when all matched files are processed")
 		flags.Int("ingestor-line-buffer-size", 10*1024*1024, "line reader buffer size")
 		flags.String("mindreader-node-working-dir", "{sf-data-dir}/workdir", "Path where mindreader will stores its files")
 
@@ -62,6 +66,14 @@ func init() {
 			if !dirExists(dir) {
 				return errors.New("ingestor logs dir must exist")
 			}
+		case modeSocket:
+			if _, _, err := parseListenAddr(viper.GetString("ingestor-listen-addr")); err != nil {
+				return err
+			}
+		case modePipe:
+			if viper.GetString("ingestor-pipe-path") == "" {
+				return errors.New("ingestor pipe path must be set")
+			}
 		}
 
 		return nil
@@ -70,6 +82,14 @@ func init() {
 	factoryFunc := func(runtime *launcher.Runtime) (launcher.App, error) {
 		sfDataDir := runtime.AbsDataDir
 
+		logsDir := viper.GetString("ingestor-logs-dir")
+		if logsDir != "" {
+			var err error
+			if logsDir, err = expandDir(logsDir); err != nil {
+				return nil, err
+			}
+		}
+
 		oneBlockStoreURL := mustReplaceDataDir(sfDataDir, viper.GetString("common-oneblock-store-url"))
 		mergedBlockStoreURL := mustReplaceDataDir(sfDataDir, viper.GetString("common-blocks-store-url"))
 		workingDir := mustReplaceDataDir(sfDataDir, viper.GetString("mindreader-node-working-dir"))
@@ -90,8 +110,14 @@ func init() {
 			return codec.NewLogReader(lines, "")
 		}
 
+		progress := newBlockProgress()
+
 		consoleReaderTransformer := func(obj interface{}) (*bstream.Block, error) {
-			return codec.BlockFromProto(obj.(*pbcodec.Block))
+			block, err := codec.BlockFromProto(obj.(*pbcodec.Block))
+			if err == nil {
+				progress.blockRead()
+			}
+			return block, err
 		}
 
 		blockStreamServer := blockstream.NewUnmanagedServer(blockstream.ServerOptionWithLogger(appLogger))
@@ -136,7 +162,13 @@ func init() {
 		return &IngestorApp{
 			Shutter:        shutter.New(),
 			mrp:            mrp,
+			progress:       progress,
 			mode:           viper.GetString("ingestor-mode"),
+			logsDir:        logsDir,
+			logsPattern:    viper.GetString("ingestor-logs-pattern"),
+			logsWatch:      viper.GetBool("ingestor-logs-watch"),
+			listenAddr:     viper.GetString("ingestor-listen-addr"),
+			pipePath:       viper.GetString("ingestor-pipe-path"),
 			lineBufferSize: viper.GetInt("ingestor-line-buffer-size"),
 		}, nil
 	}
@@ -162,9 +194,15 @@ type IngestorApp struct {
 
 	mode           string
 	logsDir        string
+	logsPattern    string
+	logsWatch      bool
+	listenAddr     string
+	pipePath       string
 	lineBufferSize int
 
-	mrp *mindreader.MindReaderPlugin
+	mrp      *mindreader.MindReaderPlugin
+	progress *blockProgress
+	streams  *streamCloser
 }
 
 func (app *IngestorApp) Run() error {
@@ -174,9 +212,40 @@ func (app *IngestorApp) Run() error {
 	zlog.Info("starting ingestor mind reader plugin")
 	app.mrp.Launch()
 
+	// Readers waiting on the node are released first, so they stop feeding the
+	// mind reader
+	app.streams = newStreamCloser()
+	app.OnTerminating(func(error) {
+		app.streams.close()
+	})
+
+	// Log files are removed once read, and the node only sends the last block
+	// again on reconnect, so the blocks read must be stored before the ingestor stops
+	if app.mode != modeStdin {
+		app.OnTerminating(func(error) {
+			<-app.mrp.Terminated()
+		})
+	}
+
 	go func() {
-		err := app.startScanner(os.Stdin)
+		var err error
+
+		switch app.mode {
+		case modeLogs:
+			err = app.startLogsReader()
+		case modeSocket:
+			err = app.startListener()
+		case modePipe:
+			err = app.startPipeReader()
+		default:
+			err = app.startScanner(os.Stdin)
+		}
+
 		zlog.Info("stanner finished", zap.Error(err))
+		if app.mode != modeStdin {
+			zlog.Info("waiting for the mind reader to store the blocks read")
+			app.mrp.Stop()
+		}
 		app.mrp.Shutdown(err)
 	}()
 
@@ -185,9 +254,9 @@ func (app *IngestorApp) Run() error {
 }
 
 func (app *IngestorApp) startScanner(src io.Reader) error {
-	scanner := bufio.NewReaderSize(os.Stdin, app.lineBufferSize)
+	scanner := bufio.NewReaderSize(src, app.lineBufferSize)
 
-	for {
+	for !app.IsTerminating() {
 		line, err := scanner.ReadString('\n')
 		if err != nil {
 			if err != io.EOF {
@@ -201,6 +270,10 @@ func (app *IngestorApp) startScanner(src io.Reader) error {
 			}
 		}
 
-		app.mrp.LogLine(strings.TrimSpace(line))
+		line = strings.TrimSpace(line)
+		app.progress.lineSent(line)
+		app.mrp.LogLine(line)
 	}
+
+	return nil
 }
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+func makeFifo(path string) error {
+	return syscall.Mkfifo(path, 0600)
+}
+
+// holdFifo opens the named pipe for writing without waiting for a reader
+func holdFifo(path string) (io.Closer, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func makeFifo(path string) error {
+	return errors.New("named pipes are not supported on windows")
+}
+
+func holdFifo(path string) (io.Closer, error) {
+	return nil, errors.New("named pipes are not supported on windows")
+}
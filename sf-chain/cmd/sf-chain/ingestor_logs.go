@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/figment-networks/graph-instrumentation-example/sf-chain/codec"
+)
+
+// Delay between two listings of the logs dir once all files are read
+const logsPollInterval = time.Second
+
+// startLogsReader reads the log files rotated by the node, oldest first, and
+// removes each file once the mind reader has read all of its blocks. The file the
+// node is still writing has no sequence number in its name and is left alone.
+func (app *IngestorApp) startLogsReader() error {
+	zlog.Info("reading log files", zap.String("dir", app.logsDir), zap.String("pattern", app.logsPattern))
+
+	for !app.IsTerminating() {
+		files, err := listRotatedFiles(app.logsDir, app.logsPattern)
+		if err != nil {
+			return err
+		}
+
+		if len(files) == 0 {
+			if !app.logsWatch {
+				zlog.Info("all log files processed")
+				return nil
+			}
+
+			select {
+			case <-time.After(logsPollInterval):
+			case <-app.Terminating():
+			}
+			continue
+		}
+
+		for _, path := range files {
+			if app.IsTerminating() {
+				break
+			}
+			if err := app.readLogFile(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// listRotatedFiles returns the paths of the log files rotated by the node with
+// given suffix, in the order they were rotated. Rotated files are named
+// <name>-<sequence>-<first height>-<last height><ext>, the sequence number orders
+// them rather than the heights, as a rollback lowers the heights of the blocks
+// that follow it.
+func listRotatedFiles(dir string, suffix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type rotatedFile struct {
+		name string
+		seq  uint64
+	}
+
+	var files []rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		seq, err := parseRotatedSequence(name)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{name: name, seq: seq})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].seq < files[j].seq
+	})
+
+	paths := make([]string, len(files))
+	for idx, file := range files {
+		paths[idx] = filepath.Join(dir, file.name)
+	}
+
+	return paths, nil
+}
+
+// parseRotatedSequence returns the sequence number of a rotated log file name
+func parseRotatedSequence(name string) (uint64, error) {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	// Sequence numbers are zero padded to 6 digits at least, heights to 10
+	parts := strings.Split(name, "-")
+	if len(parts) < 4 {
+		return 0, errors.New("name has no sequence number and height range")
+	}
+	parts = parts[len(parts)-3:]
+	if len(parts[0]) < 6 || len(parts[1]) < 10 || len(parts[2]) < 10 {
+		return 0, errors.New("name has no sequence number and height range")
+	}
+
+	for _, part := range parts[1:] {
+		if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid height: %w", err)
+		}
+	}
+
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sequence number: %w", err)
+	}
+	return seq, nil
+}
+
+func (app *IngestorApp) readLogFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	zlog.Info("reading log file", zap.String("file", filepath.Base(path)))
+
+	err = app.startScanner(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Lines are only queued so far, the file is kept until the mind reader went
+	// through its last block. A stopped ingestor reads the file again when restarted.
+	if !app.progress.waitRead(app.Terminating(), app.mrp.Terminating()) {
+		zlog.Info("keeping log file, its blocks may not be read", zap.String("file", filepath.Base(path)))
+		return nil
+	}
+
+	return os.Remove(path)
+}
+
+// blockProgress tracks the blocks sent to the mind reader as log lines, and the
+// blocks it read out of them
+type blockProgress struct {
+	sent uint64
+	read uint64
+
+	// Notified after a block is read
+	readCh chan struct{}
+}
+
+func newBlockProgress() *blockProgress {
+	return &blockProgress{
+		readCh: make(chan struct{}, 1),
+	}
+}
+
+// lineSent counts the blocks ended by the lines sent to the mind reader
+func (p *blockProgress) lineSent(line string) {
+	if strings.HasPrefix(line, codec.LogPrefix+" "+codec.MsgEnd+" ") {
+		atomic.AddUint64(&p.sent, 1)
+	}
+}
+
+func (p *blockProgress) blockRead() {
+	atomic.AddUint64(&p.read, 1)
+
+	select {
+	case p.readCh <- struct{}{}:
+	default:
+	}
+}
+
+// waitRead waits until all blocks sent so far are read, it returns false when
+// the ingestor or the mind reader stops first
+func (p *blockProgress) waitRead(terminating <-chan struct{}, readerTerminating <-chan struct{}) bool {
+	for atomic.LoadUint64(&p.read) < atomic.LoadUint64(&p.sent) {
+		select {
+		case <-p.readCh:
+		case <-terminating:
+			return false
+		case <-readerTerminating:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// parseListenAddr splits a unix:///path or tcp://host:port address into its
+// network and address parts
+func parseListenAddr(addr string) (network string, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	default:
+		return "", "", fmt.Errorf("ingestor listen addr must be a unix:// or tcp:// address, got %q", addr)
+	}
+
+	if address == "" {
+		return "", "", fmt.Errorf("ingestor listen addr %q has no path or host", addr)
+	}
+	return network, address, nil
+}
+
+// startListener accepts the connections of the instrumented node one at a time.
+// The node connects again whenever it restarts or the connection breaks.
+func (app *IngestorApp) startListener() error {
+	network, address, err := parseListenAddr(app.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	// The socket file of a previous run is left behind when it did not shut down cleanly
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	app.streams.add(listener)
+
+	zlog.Info("waiting for node connections", zap.String("addr", app.listenAddr))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if app.IsTerminating() {
+				return nil
+			}
+			return err
+		}
+
+		zlog.Info("node connected", zap.Stringer("remote", conn.RemoteAddr()))
+		app.streams.add(conn)
+		err = app.readStream(conn)
+		app.streams.remove(conn)
+		conn.Close()
+		zlog.Info("node disconnected", zap.Error(err))
+	}
+}
+
+// startPipeReader reads the named pipe again every time the node opens it
+func (app *IngestorApp) startPipeReader() error {
+	info, err := os.Stat(app.pipePath)
+	switch {
+	case os.IsNotExist(err):
+		if err := makeFifo(app.pipePath); err != nil {
+			return fmt.Errorf("cant create named pipe %s: %w", app.pipePath, err)
+		}
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeNamedPipe == 0:
+		return fmt.Errorf("%s is not a named pipe", app.pipePath)
+	}
+
+	release := &fifoRelease{path: app.pipePath, done: make(chan struct{})}
+	defer close(release.done)
+	app.streams.add(release)
+
+	zlog.Info("waiting for node output", zap.String("pipe", app.pipePath))
+
+	for !app.IsTerminating() {
+		// Opening blocks until the node opens the pipe for writing
+		pipe, err := os.Open(app.pipePath)
+		if err != nil {
+			return err
+		}
+		if app.IsTerminating() {
+			pipe.Close()
+			break
+		}
+
+		zlog.Info("node opened the pipe")
+		app.streams.add(pipe)
+		err = app.readStream(pipe)
+		app.streams.remove(pipe)
+		pipe.Close()
+		zlog.Info("node closed the pipe", zap.Error(err))
+	}
+
+	return nil
+}
+
+// readStream reads lines until the writer goes away. Unlike startScanner, an
+// unterminated last line is dropped, the node writes it again once reconnected.
+func (app *IngestorApp) readStream(src io.Reader) error {
+	scanner := bufio.NewReaderSize(src, app.lineBufferSize)
+
+	for !app.IsTerminating() {
+		line, err := scanner.ReadString('\n')
+		if err != nil {
+			if app.IsTerminating() {
+				return nil
+			}
+			if len(line) > 0 {
+				zlog.Warn("dropping incomplete line", zap.Int("length", len(line)))
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		app.mrp.LogLine(strings.TrimSpace(line))
+	}
+
+	return nil
+}
+
+// streamCloser closes the listener, connection or pipe the ingestor waits on
+// once it terminates, which unblocks the reader
+type streamCloser struct {
+	lock    sync.Mutex
+	closers map[io.Closer]bool
+	closed  bool
+}
+
+func newStreamCloser() *streamCloser {
+	return &streamCloser{closers: map[io.Closer]bool{}}
+}
+
+// add registers a stream to close, it is closed right away when the ingestor
+// already terminates
+func (c *streamCloser) add(closer io.Closer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		closer.Close()
+		return
+	}
+	c.closers[closer] = true
+}
+
+func (c *streamCloser) remove(closer io.Closer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.closers, closer)
+}
+
+func (c *streamCloser) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	for closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			zlog.Warn("cant close node stream", zap.Error(err))
+		}
+	}
+	c.closers = map[io.Closer]bool{}
+}
+
+// fifoRelease lets a reader blocked on opening the named pipe through. Opening
+// waits for a writer, so the write end is held until the reader is done.
+type fifoRelease struct {
+	path string
+	done chan struct{}
+}
+
+func (r *fifoRelease) Close() error {
+	writer, err := holdFifo(r.path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-r.done
+		writer.Close()
+	}()
+	return nil
+}
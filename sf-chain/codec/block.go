@@ -22,7 +22,7 @@ func BlockFromProto(b *pbcodec.Block) (*bstream.Block, error) {
 		Number:         b.Height,
 		PreviousId:     b.PrevHash,
 		Timestamp:      time.Unix(0, int64(b.Timestamp)).UTC(),
-		LibNum:         b.Height - 1,
+		LibNum:         b.LibNum,
 		PayloadKind:    pbbstream.Protocol_UNKNOWN, // TODO: Create dummy protocol
 		PayloadVersion: 1,
 	}
@@ -2,7 +2,10 @@ package codec
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"strconv"
 	"strings"
@@ -14,17 +17,51 @@ import (
 const (
 	LogPrefix = "DMLOG"
 
+	MsgInit = "INIT"
+
 	MsgBegin = "BLOCK_BEGIN"
 	MsgBlock = "BLOCK"
 	MsgEnd   = "BLOCK_END"
+
+	// Transactions mode, where the block is written in parts
+	MsgTrxBegin      = "TRX_BEGIN"
+	MsgBalanceChange = "BALANCE_CHANGE"
+	MsgEvent         = "EVENT"
+	MsgTrxEnd        = "TRX_END"
+	MsgBlockHeader   = "BLOCK_HEADER"
+
+	MsgRollback = "ROLLBACK"
 )
 
+// SupportedProtocolVersions lists the versions of the node INIT line this reader
+// understands, streams of other versions are refused
+var SupportedProtocolVersions = []uint64{1, 2}
+
+// Protocol version from which BLOCK and BLOCK_END lines carry checksums
+const checksumProtocolVersion = 2
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 type LogReader struct {
 	prefix    string
 	prefixLen int
 	lines     chan string
 	done      chan interface{}
+	init      *InitCtx
 	parseCtx  *ParseCtx
+	rollback  *RollbackCtx
+
+	// Byte offset of the line being parsed, and of the next one
+	offset     uint64
+	nextOffset uint64
+
+	// Error of a line that may have been cut short by a failed write, which is
+	// only reported when the node doesn't start the block over right after it
+	torn error
+
+	// Last block read, which a node writing to a socket or pipe writes again
+	// after it reconnects
+	lastBlock *pbcodec.Block
 }
 
 type LogEntry struct {
@@ -35,6 +72,30 @@ type LogEntry struct {
 type ParseCtx struct {
 	Height uint64
 	Block  *pbcodec.Block
+
+	// Transactions written in transactions mode, and the one still being read
+	Transactions []*pbcodec.Transaction
+	Trx          *pbcodec.Transaction
+
+	// Next expected ordinal within the block
+	Ordinal uint64
+
+	// CRC32C of the payloads read for the block
+	Checksum hash.Hash32
+}
+
+// InitCtx describes the node that produces the stream
+type InitCtx struct {
+	ProtocolVersion uint64
+	ChainID         string
+	NodeVersion     string
+}
+
+// RollbackCtx is the block the chain was rewound to, the next block must extend it
+type RollbackCtx struct {
+	Height     uint64
+	Hash       string
+	FromHeight uint64
 }
 
 func NewLogReader(lines chan string, prefix string) (*LogReader, error) {
@@ -63,9 +124,28 @@ func (r *LogReader) Done() <-chan interface{} {
 
 func (r *LogReader) next() (interface{}, error) {
 	for line := range r.lines {
+		// Lines are read without their line break
+		r.offset = r.nextOffset
+		r.nextOffset += uint64(len(line)) + 1
+
+		if r.torn != nil && strings.HasPrefix(line, r.prefix) {
+			if !r.isRestart(line) {
+				return nil, r.torn
+			}
+			if !r.isInit(line) {
+				r.torn = nil
+			}
+		}
+
 		data, err := r.parseLine(line)
 		if err != nil {
-			return nil, err
+			// A node that can't truncate its output ends a partially written line
+			// with a line break, and writes the block again from its BLOCK_BEGIN line
+			if r.init == nil || r.isInit(line) {
+				return nil, err
+			}
+			r.torn = err
+			continue
 		}
 
 		if data != nil {
@@ -73,42 +153,142 @@ func (r *LogReader) next() (interface{}, error) {
 		}
 	}
 
+	if r.torn != nil {
+		return nil, r.torn
+	}
 	return nil, io.EOF
 }
 
+// isRestart tells if the line may follow a torn line: the node starts the
+// unfinished block over at the same height, or writes again the block or rollback
+// that was cut short while no block was in progress. The INIT line the node writes
+// after it reconnects may come first.
+func (r *LogReader) isRestart(line string) bool {
+	tokens := r.tokens(line)
+	if len(tokens) < 2 {
+		return false
+	}
+
+	switch tokens[0] {
+	case MsgInit:
+		return true
+	case MsgBegin:
+		height, err := strconv.ParseUint(tokens[1], 10, 64)
+		return err == nil && (r.parseCtx == nil || height == r.parseCtx.Height)
+	case MsgRollback:
+		return r.parseCtx == nil
+	}
+	return false
+}
+
+func (r *LogReader) isInit(line string) bool {
+	tokens := r.tokens(line)
+	return len(tokens) > 0 && tokens[0] == MsgInit
+}
+
+// tokens splits a line with the log prefix into its message fields
+func (r *LogReader) tokens(line string) []string {
+	if len(line) <= r.prefixLen+1 {
+		return nil
+	}
+	return strings.Split(line[r.prefixLen+1:], " ")
+}
+
 func (r *LogReader) parseLine(line string) (interface{}, error) {
 	if !strings.HasPrefix(line, r.prefix) {
 		return nil, nil
 	}
 
-	tokens := strings.Split(line[r.prefixLen+1:], " ")
+	tokens := r.tokens(line)
 	if len(tokens) < 2 {
 		return nil, fmt.Errorf("invalid log line format: %s", line)
 	}
 
+	// Blocks can't be decoded safely until the protocol version is known
+	if r.init == nil && tokens[0] != MsgInit {
+		return nil, fmt.Errorf("unexpected %v message before the INIT message, the stream comes from an unsupported node version", tokens[0])
+	}
+
 	switch tokens[0] {
+	case MsgInit:
+		return nil, r.processMsgInit(tokens[1:])
 	case MsgBegin:
 		return nil, r.processMsgBegin(tokens[1:])
 	case MsgEnd:
 		return r.processMsgEnd(tokens[1:])
 	case MsgBlock:
 		return nil, r.processMsgBlock(tokens[1:])
+	case MsgTrxBegin:
+		return nil, r.processMsgTrxBegin(tokens[1:])
+	case MsgBalanceChange:
+		return nil, r.processMsgBalanceChange(tokens[1:])
+	case MsgEvent:
+		return nil, r.processMsgEvent(tokens[1:])
+	case MsgTrxEnd:
+		return nil, r.processMsgTrxEnd(tokens[1:])
+	case MsgBlockHeader:
+		return nil, r.processMsgBlockHeader(tokens[1:])
+	case MsgRollback:
+		return nil, r.processMsgRollback(tokens[1:])
 	default:
 		return nil, fmt.Errorf("unsupported kind: %v", tokens[0])
 	}
 }
 
+// processMsgInit checks the protocol version of the stream. The node writes the
+// INIT line again when it restarts or reconnects, which may happen within a block.
+// The node then starts over the unfinished block, so its partial data is discarded.
+func (r *LogReader) processMsgInit(tokens []string) error {
+	if len(tokens) != 3 {
+		return fmt.Errorf("invalid init message: %v", tokens)
+	}
+
+	version, err := strconv.ParseUint(tokens[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid protocol version %q: %w", tokens[0], err)
+	}
+
+	supported := false
+	for _, v := range SupportedProtocolVersions {
+		supported = supported || v == version
+	}
+	if !supported {
+		return fmt.Errorf("unsupported protocol version %v of node %v, supported versions are %v", version, tokens[2], SupportedProtocolVersions)
+	}
+
+	if r.init != nil && r.init.ChainID != tokens[1] {
+		return fmt.Errorf("stream of chain %q continues with chain %q", r.init.ChainID, tokens[1])
+	}
+
+	r.init = &InitCtx{
+		ProtocolVersion: version,
+		ChainID:         tokens[1],
+		NodeVersion:     tokens[2],
+	}
+	r.parseCtx = nil
+	return nil
+}
+
 func (r *LogReader) processMsgBegin(tokens []string) error {
 	height, err := strconv.ParseUint(tokens[0], 10, 64)
 	if err != nil {
 		return err
 	}
 
-	if r.parseCtx != nil && height < r.parseCtx.Height+1 {
-		return fmt.Errorf("unexpected begin message at height %v", height)
+	// Heights are not required to increase, the node emits sibling blocks
+	// when a fork happens. Blocks must not overlap though.
+	if r.parseCtx != nil {
+		// A node writing to a socket or pipe starts over the unfinished block
+		// after it reconnects, the partial data is discarded
+		if height != r.parseCtx.Height {
+			return fmt.Errorf("unexpected begin message at height %v, block %v is not finished", height, r.parseCtx.Height)
+		}
 	}
 
-	r.parseCtx = &ParseCtx{Height: height}
+	r.parseCtx = &ParseCtx{
+		Height:   height,
+		Checksum: crc32.New(checksumTable),
+	}
 	return nil
 }
 
@@ -126,23 +306,344 @@ func (r *LogReader) processMsgEnd(tokens []string) (interface{}, error) {
 		return nil, fmt.Errorf("invalid end marker at height %v", height)
 	}
 
-	return r.parseCtx.Block, nil
+	if r.parseCtx.Trx != nil {
+		return nil, fmt.Errorf("unexpected end marker at height %v, transaction %v is not finished", height, len(r.parseCtx.Transactions))
+	}
+	if r.parseCtx.Block == nil && len(r.parseCtx.Transactions) > 0 {
+		return nil, fmt.Errorf("missing block header at height %v", height)
+	}
+
+	if r.hasChecksums() {
+		if len(tokens) != 2 {
+			return nil, r.corrupted(MsgEnd, fmt.Errorf("invalid end marker: %v", tokens))
+		}
+		if err := r.verifyChecksum(MsgEnd, tokens[1], r.parseCtx.Checksum.Sum32()); err != nil {
+			return nil, err
+		}
+	}
+
+	block := r.parseCtx.Block
+	r.parseCtx = nil
+
+	if last := r.lastBlock; last != nil && block != nil && block.Height == last.Height && block.Hash == last.Hash {
+		return nil, nil
+	}
+	if block != nil {
+		r.lastBlock = block
+	}
+
+	if rollback := r.rollback; rollback != nil && block != nil {
+		if block.Height != rollback.Height+1 || block.PrevHash != rollback.Hash {
+			return nil, fmt.Errorf("block %v does not extend the rollback block %v %s", block.Height, rollback.Height, rollback.Hash)
+		}
+		r.rollback = nil
+	}
+
+	return block, nil
 }
 
 func (r *LogReader) processMsgBlock(tokens []string) error {
+	if r.parseCtx == nil {
+		return errors.New("unexpected block message without begin marker")
+	}
+
+	if r.parseCtx.Block != nil || len(r.parseCtx.Transactions) > 0 || r.parseCtx.Trx != nil {
+		return fmt.Errorf("unexpected block message, block %v data is already read", r.parseCtx.Height)
+	}
+
+	payload := tokens[0]
+	if r.hasChecksums() {
+		if len(tokens) != 2 {
+			return r.corrupted(MsgBlock, fmt.Errorf("invalid block message with %v fields", len(tokens)))
+		}
+		payload = tokens[1]
+	}
+
 	block := &pbcodec.Block{}
-	if _, err := parseFromProto(tokens[0], block); err != nil {
+	data, err := r.decodePayload(MsgBlock, payload, block)
+	if err != nil {
 		return err
 	}
 
+	if r.hasChecksums() {
+		if err := r.verifyChecksum(MsgBlock, tokens[0], crc32.Checksum(data, checksumTable)); err != nil {
+			return err
+		}
+	}
+
 	r.parseCtx.Block = block
 	return nil
 }
 
-func parseFromProto(data string, message proto.Message) (proto.Message, error) {
-	buf, err := base64.StdEncoding.DecodeString(data)
+func (r *LogReader) processMsgTrxBegin(tokens []string) error {
+	if len(tokens) != 4 {
+		return fmt.Errorf("invalid transaction begin message: %v", tokens)
+	}
+
+	values, err := r.parsePosition(MsgTrxBegin, tokens[0:3])
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if r.parseCtx.Block != nil || r.parseCtx.Trx != nil {
+		return fmt.Errorf("unexpected transaction begin message at height %v", r.parseCtx.Height)
+	}
+	if index := values[1]; index != uint64(len(r.parseCtx.Transactions)) {
+		return fmt.Errorf("unexpected transaction %v at height %v, expected %v", index, r.parseCtx.Height, len(r.parseCtx.Transactions))
+	}
+
+	if err := r.checkOrdinal(MsgTrxBegin, values[2]); err != nil {
+		return err
+	}
+
+	trx := &pbcodec.Transaction{}
+	if _, err := r.decodePayload(MsgTrxBegin, tokens[3], trx); err != nil {
+		return err
+	}
+
+	trx.BeginOrdinal = values[2]
+	trx.Events = []*pbcodec.Event{}
+	trx.BalanceChanges = nil
+
+	r.parseCtx.Trx = trx
+	return nil
+}
+
+// processMsgBalanceChange reads a balance change, which are written as the
+// transaction runs and come before its events.
+func (r *LogReader) processMsgBalanceChange(tokens []string) error {
+	if len(tokens) != 5 {
+		return fmt.Errorf("invalid balance change message: %v", tokens)
+	}
+
+	values, err := r.parsePosition(MsgBalanceChange, tokens[0:4])
+	if err != nil {
+		return err
+	}
+
+	trx := r.parseCtx.Trx
+	if trx == nil || values[1] != uint64(len(r.parseCtx.Transactions)) {
+		return fmt.Errorf("unexpected balance change message for transaction %v at height %v", values[1], r.parseCtx.Height)
+	}
+	if len(trx.Events) > 0 {
+		return fmt.Errorf("unexpected balance change message after events of transaction %v at height %v", values[1], r.parseCtx.Height)
+	}
+	if index := values[2]; index != uint64(len(trx.BalanceChanges)) {
+		return fmt.Errorf("unexpected balance change %v of transaction %v at height %v, expected %v", index, values[1], r.parseCtx.Height, len(trx.BalanceChanges))
+	}
+
+	if err := r.checkOrdinal(MsgBalanceChange, values[3]); err != nil {
+		return err
+	}
+
+	change := &pbcodec.BalanceChange{}
+	if _, err := r.decodePayload(MsgBalanceChange, tokens[4], change); err != nil {
+		return err
+	}
+
+	change.Ordinal = values[3]
+	trx.BalanceChanges = append(trx.BalanceChanges, change)
+
+	return nil
+}
+
+func (r *LogReader) processMsgEvent(tokens []string) error {
+	if len(tokens) != 5 {
+		return fmt.Errorf("invalid event message: %v", tokens)
+	}
+
+	values, err := r.parsePosition(MsgEvent, tokens[0:4])
+	if err != nil {
+		return err
+	}
+
+	trx := r.parseCtx.Trx
+	if trx == nil || values[1] != uint64(len(r.parseCtx.Transactions)) {
+		return fmt.Errorf("unexpected event message for transaction %v at height %v", values[1], r.parseCtx.Height)
+	}
+	if index := values[2]; index != uint64(len(trx.Events)) {
+		return fmt.Errorf("unexpected event %v of transaction %v at height %v, expected %v", index, values[1], r.parseCtx.Height, len(trx.Events))
+	}
+
+	if err := r.checkOrdinal(MsgEvent, values[3]); err != nil {
+		return err
+	}
+
+	event := &pbcodec.Event{}
+	if _, err := r.decodePayload(MsgEvent, tokens[4], event); err != nil {
+		return err
+	}
+
+	event.Ordinal = values[3]
+	trx.Events = append(trx.Events, event)
+
+	return nil
+}
+
+func (r *LogReader) processMsgTrxEnd(tokens []string) error {
+	if len(tokens) != 4 {
+		return fmt.Errorf("invalid transaction end message: %v", tokens)
+	}
+
+	values, err := r.parsePosition(MsgTrxEnd, tokens)
+	if err != nil {
+		return err
+	}
+
+	trx := r.parseCtx.Trx
+	if trx == nil || values[1] != uint64(len(r.parseCtx.Transactions)) {
+		return fmt.Errorf("unexpected transaction end message for transaction %v at height %v", values[1], r.parseCtx.Height)
+	}
+	if count := values[3]; count != uint64(len(trx.Events)) {
+		return fmt.Errorf("transaction %v at height %v has %v events, expected %v", values[1], r.parseCtx.Height, len(trx.Events), count)
+	}
+
+	if err := r.checkOrdinal(MsgTrxEnd, values[2]); err != nil {
+		return err
+	}
+
+	trx.EndOrdinal = values[2]
+
+	r.parseCtx.Transactions = append(r.parseCtx.Transactions, trx)
+	r.parseCtx.Trx = nil
+
+	return nil
+}
+
+func (r *LogReader) processMsgBlockHeader(tokens []string) error {
+	if len(tokens) != 3 {
+		return fmt.Errorf("invalid block header message: %v", tokens)
+	}
+
+	values, err := r.parsePosition(MsgBlockHeader, tokens[0:2])
+	if err != nil {
+		return err
+	}
+
+	if r.parseCtx.Block != nil || r.parseCtx.Trx != nil {
+		return fmt.Errorf("unexpected block header message at height %v", r.parseCtx.Height)
+	}
+	if count := values[1]; count != uint64(len(r.parseCtx.Transactions)) {
+		return fmt.Errorf("block %v has %v transactions, expected %v", r.parseCtx.Height, len(r.parseCtx.Transactions), count)
+	}
+
+	block := &pbcodec.Block{}
+	if _, err := r.decodePayload(MsgBlockHeader, tokens[2], block); err != nil {
+		return err
+	}
+
+	block.Transactions = r.parseCtx.Transactions
+	if block.Transactions == nil {
+		block.Transactions = []*pbcodec.Transaction{}
 	}
-	return message, proto.Unmarshal(buf, message)
+
+	r.parseCtx.Block = block
+	return nil
+}
+
+// parsePosition parses the numeric tokens of a transactions mode message, which
+// start with the block height.
+func (r *LogReader) parsePosition(kind string, tokens []string) ([]uint64, error) {
+	if r.parseCtx == nil {
+		return nil, fmt.Errorf("unexpected %s message without begin marker", kind)
+	}
+
+	values := make([]uint64, len(tokens))
+	for idx, token := range tokens {
+		value, err := strconv.ParseUint(token, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s message: %v", kind, err)
+		}
+		values[idx] = value
+	}
+
+	if values[0] != r.parseCtx.Height {
+		return nil, fmt.Errorf("unexpected %s message at height %v, block %v is not finished", kind, values[0], r.parseCtx.Height)
+	}
+
+	return values, nil
+}
+
+// checkOrdinal makes sure the parts of the block are read in their execution order
+func (r *LogReader) checkOrdinal(kind string, ordinal uint64) error {
+	if ordinal != r.parseCtx.Ordinal {
+		return fmt.Errorf("unexpected %s ordinal %v at height %v, expected %v", kind, ordinal, r.parseCtx.Height, r.parseCtx.Ordinal)
+	}
+
+	r.parseCtx.Ordinal++
+	return nil
+}
+
+// processMsgRollback handles the rewind of the chain. The replacement blocks
+// that follow are regular blocks on a new branch, the previous ones up to the
+// from height are abandoned.
+func (r *LogReader) processMsgRollback(tokens []string) error {
+	if len(tokens) != 3 {
+		return fmt.Errorf("invalid rollback message: %v", tokens)
+	}
+
+	if r.parseCtx != nil {
+		return fmt.Errorf("unexpected rollback message, block %v is not finished", r.parseCtx.Height)
+	}
+
+	height, err := strconv.ParseUint(tokens[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	fromHeight, err := strconv.ParseUint(tokens[2], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if fromHeight <= height {
+		return fmt.Errorf("invalid rollback from height %v to height %v", fromHeight, height)
+	}
+
+	r.rollback = &RollbackCtx{
+		Height:     height,
+		Hash:       tokens[1],
+		FromHeight: fromHeight,
+	}
+	return nil
+}
+
+// decodePayload decodes the base64 payload of a block message into message, and
+// adds it to the checksum of the block. It returns the decoded payload.
+func (r *LogReader) decodePayload(kind string, payload string, message proto.Message) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, r.corrupted(kind, err)
+	}
+
+	r.parseCtx.Checksum.Write(data)
+
+	if err := proto.Unmarshal(data, message); err != nil {
+		return nil, r.corrupted(kind, err)
+	}
+	return data, nil
+}
+
+// hasChecksums tells if the BLOCK and BLOCK_END lines of the stream carry checksums
+func (r *LogReader) hasChecksums() bool {
+	return r.init.ProtocolVersion >= checksumProtocolVersion
+}
+
+// verifyChecksum compares the hex checksum of a message with the one of the payload
+func (r *LogReader) verifyChecksum(kind string, token string, checksum uint32) error {
+	expected, err := strconv.ParseUint(token, 16, 32)
+	if err != nil {
+		return r.corrupted(kind, fmt.Errorf("invalid checksum %q", token))
+	}
+
+	if uint32(expected) != checksum {
+		return r.corrupted(kind, fmt.Errorf("checksum %08x does not match payload checksum %08x", expected, checksum))
+	}
+	return nil
+}
+
+// corrupted reports a message of the current block that was damaged in transit or
+// partially written, along with its position in the stream
+func (r *LogReader) corrupted(kind string, err error) error {
+	return fmt.Errorf("corrupted %s message at height %v, byte offset %v: %w", kind, r.parseCtx.Height, r.offset, err)
 }
@@ -0,0 +1,448 @@
+package codec
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pbcodec "github.com/figment-networks/graph-instrumentation-example/chain/proto"
+)
+
+var (
+	block1  = &pbcodec.Block{Height: 1, Hash: "h1", PrevHash: "h0"}
+	block2  = &pbcodec.Block{Height: 2, Hash: "h2", PrevHash: "h1"}
+	block3  = &pbcodec.Block{Height: 3, Hash: "h3", PrevHash: "h2"}
+	block2b = &pbcodec.Block{Height: 2, Hash: "h2b", PrevHash: "h1"}
+
+	// Block 1 with a transfer, as written in transactions mode
+	trxBlock1 = &pbcodec.Block{Height: 1, Hash: "h1", PrevHash: "h0", Transactions: []*pbcodec.Transaction{{
+		Hash:           "t1",
+		BeginOrdinal:   0,
+		BalanceChanges: []*pbcodec.BalanceChange{{Address: "a", Ordinal: 1}},
+		Events:         []*pbcodec.Event{{Type: "e", Ordinal: 2}},
+		EndOrdinal:     3,
+	}}}
+)
+
+func TestLogReader(t *testing.T) {
+	cases := []struct {
+		name  string
+		lines []string
+		want  []*pbcodec.Block
+	}{
+		{
+			name: "block mode",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK b1e8ba90 CAISAmgyGgJoMQ==",
+				"DMLOG BLOCK_END 2 b1e8ba90",
+				"DMLOG BLOCK_BEGIN 3",
+				"DMLOG BLOCK 6e97f080 CAMSAmgzGgJoMg==",
+				"DMLOG BLOCK_END 3 6e97f080",
+			},
+			want: []*pbcodec.Block{block1, block2, block3},
+		},
+		{
+			name: "protocol version 1 without checksums",
+			lines: []string{
+				"DMLOG INIT 1 test-chain v0.9.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "transactions mode",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG TRX_BEGIN 1 0 0 EgJ0MQ==",
+				"DMLOG BALANCE_CHANGE 1 0 0 1 CgFh",
+				"DMLOG EVENT 1 0 0 2 CgFl",
+				"DMLOG TRX_END 1 0 3 1",
+				"DMLOG BLOCK_HEADER 1 1 CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 df6a7ec3",
+			},
+			want: []*pbcodec.Block{trxBlock1},
+		},
+		{
+			name: "sibling blocks of a fork",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK b1e8ba90 CAISAmgyGgJoMQ==",
+				"DMLOG BLOCK_END 2 b1e8ba90",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK 2d37ec46 CAISA2gyYhoCaDE=",
+				"DMLOG BLOCK_END 2 2d37ec46",
+			},
+			want: []*pbcodec.Block{block2, block2b},
+		},
+		{
+			name: "lines without prefix are ignored",
+			lines: []string{
+				"starting node",
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"processing block",
+				"DMLOG BLOCK_END 1 121f854e",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "block begin restarts the unfinished block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG TRX_BEGIN 1 0 0 EgJ0MQ==",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "init within a block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "rollback continues with the next block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK b1e8ba90 CAISAmgyGgJoMQ==",
+				"DMLOG BLOCK_END 2 b1e8ba90",
+				"DMLOG ROLLBACK 1 h1 2",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK 2d37ec46 CAISA2gyYhoCaDE=",
+				"DMLOG BLOCK_END 2 2d37ec46",
+			},
+			want: []*pbcodec.Block{block2, block2b},
+		},
+		{
+			name: "stream ends within a block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+				"DMLOG BLOCK_BEGIN 2",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "torn line followed by the restarted block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAm",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "torn block end followed by the restarted block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_E",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "torn prefix between blocks",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+			},
+			want: []*pbcodec.Block{block1},
+		},
+		{
+			name: "torn line followed by init and the restarted block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG TRX_BEGIN 1 0 0 EgJ0MQ==",
+				"DMLOG BALANCE_CHANGE 1 0",
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG TRX_BEGIN 1 0 0 EgJ0MQ==",
+				"DMLOG BALANCE_CHANGE 1 0 0 1 CgFh",
+				"DMLOG EVENT 1 0 0 2 CgFl",
+				"DMLOG TRX_END 1 0 3 1",
+				"DMLOG BLOCK_HEADER 1 1 CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 df6a7ec3",
+			},
+			want: []*pbcodec.Block{trxBlock1},
+		},
+		{
+			name: "last block written again after a reconnect",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK b1e8ba90 CAISAmgyGgJoMQ==",
+				"DMLOG BLOCK_END 2 b1e8ba90",
+			},
+			want: []*pbcodec.Block{block1, block2},
+		},
+		{
+			name: "last block written again within the next block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 121f854e",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK b1e8ba90 CAISAmgyGgJoMQ==",
+				"DMLOG BLOCK_END 2 b1e8ba90",
+			},
+			want: []*pbcodec.Block{block1, block2},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			blocks, err := readAll(c.lines)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(blocks) != len(c.want) {
+				t.Fatalf("got %d blocks, want %d", len(blocks), len(c.want))
+			}
+			for idx, block := range blocks {
+				if !proto.Equal(block, c.want[idx]) {
+					t.Errorf("block %d differs:\ngot  %v\nwant %v", idx, block, c.want[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestLogReaderErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		lines []string
+		err   string
+	}{
+		{
+			name: "block before init",
+			lines: []string{
+				"DMLOG BLOCK_BEGIN 1",
+			},
+			err: "unexpected BLOCK_BEGIN message before the INIT message",
+		},
+		{
+			name: "unsupported protocol version",
+			lines: []string{
+				"DMLOG INIT 3 test-chain v2.0.0",
+			},
+			err: "unsupported protocol version 3 of node v2.0.0",
+		},
+		{
+			name: "chain switch",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG INIT 2 other-chain v1.0.0",
+			},
+			err: `stream of chain "test-chain" continues with chain "other-chain"`,
+		},
+		{
+			name: "corrupted block payload",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMQ==",
+				"DMLOG BLOCK_END 1 121f854e",
+			},
+			err: "corrupted BLOCK message at height 1, byte offset 51: checksum 121f854e does not match",
+		},
+		{
+			name: "truncated block line",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAm",
+			},
+			err: "corrupted BLOCK message at height 1, byte offset 51",
+		},
+		{
+			name: "block line without checksum",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK CAESAmgxGgJoMA==",
+			},
+			err: "corrupted BLOCK message at height 1, byte offset 51: invalid block message with 1 fields",
+		},
+		{
+			name: "block end checksum mismatch",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 00000000",
+			},
+			err: "corrupted BLOCK_END message at height 1, byte offset 89: checksum 00000000 does not match",
+		},
+		{
+			name: "corrupted event payload",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG TRX_BEGIN 1 0 0 EgJ0MQ==",
+				"DMLOG BALANCE_CHANGE 1 0 0 1 CgFh",
+				"DMLOG EVENT 1 0 0 2 CgFm",
+				"DMLOG TRX_END 1 0 3 1",
+				"DMLOG BLOCK_HEADER 1 1 CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_END 1 df6a7ec3",
+			},
+			err: "corrupted BLOCK_END message at height 1, byte offset 203: checksum df6a7ec3 does not match",
+		},
+		{
+			name: "missing balance change",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG TRX_BEGIN 1 0 0 EgJ0MQ==",
+				"DMLOG EVENT 1 0 0 2 CgFl",
+			},
+			err: "unexpected EVENT ordinal 2 at height 1, expected 1",
+		},
+		{
+			name: "event count mismatch",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG TRX_BEGIN 1 0 0 EgJ0MQ==",
+				"DMLOG EVENT 1 0 0 1 CgFl",
+				"DMLOG TRX_END 1 0 2 2",
+			},
+			err: "transaction 0 at height 1 has 1 events, expected 2",
+		},
+		{
+			name: "transaction count mismatch",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK_HEADER 1 1 CAESAmgxGgJoMA==",
+			},
+			err: "block 1 has 0 transactions, expected 1",
+		},
+		{
+			name: "begin at another height within a block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK_BEGIN 2",
+			},
+			err: "unexpected begin message at height 2, block 1 is not finished",
+		},
+		{
+			name: "rollback within a block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG ROLLBACK 0 h0 1",
+			},
+			err: "unexpected rollback message, block 1 is not finished",
+		},
+		{
+			name: "block not extending the rollback block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG ROLLBACK 1 hx 2",
+				"DMLOG BLOCK_BEGIN 2",
+				"DMLOG BLOCK b1e8ba90 CAISAmgyGgJoMQ==",
+				"DMLOG BLOCK_END 2 b1e8ba90",
+			},
+			err: "block 2 does not extend the rollback block 1 hx",
+		},
+		{
+			name: "torn line followed by another block",
+			lines: []string{
+				"DMLOG INIT 2 test-chain v1.0.0",
+				"DMLOG BLOCK_BEGIN 1",
+				"DMLOG BLOCK 121f854e CAESAmgxGgJoMA==",
+				"DMLOG BLOCK_E",
+				"DMLOG BLOCK_BEGIN 2",
+			},
+			err: "invalid log line format: DMLOG BLOCK_E",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := readAll(c.lines)
+			if err == nil {
+				t.Fatalf("expected error %q", c.err)
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got error %q, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+func readAll(lines []string) ([]*pbcodec.Block, error) {
+	ch := make(chan string, len(lines))
+	for _, line := range lines {
+		ch <- line
+	}
+	close(ch)
+
+	reader, err := NewLogReader(ch, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*pbcodec.Block
+	for {
+		obj, err := reader.Read()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, obj.(*pbcodec.Block))
+	}
+}
@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/figment-networks/graph-instrumentation-example/chain v0.0.0-20220120165813-bc32a1aad82a
+	github.com/golang/protobuf v1.5.2
 	github.com/lithammer/dedent v1.1.0
 	github.com/logrusorgru/aurora v2.0.3+incompatible
 	github.com/spf13/cobra v1.3.0
@@ -12,6 +13,7 @@ require (
 	github.com/streamingfast/dauth v0.0.0-20210812020920-1c83ba29add1
 	github.com/streamingfast/dbin v0.0.0-20210809205249-73d5eca35dc5
 	github.com/streamingfast/derr v0.0.0-20210811180100-9138d738bcec
+	github.com/streamingfast/dgrpc v0.0.0-20211210152421-f8cec68e0383
 	github.com/streamingfast/dlauncher v0.0.0-20211210162313-cf4aa5fc4878
 	github.com/streamingfast/dmetering v0.0.0-20210812002943-aa53fa1ce172
 	github.com/streamingfast/dmetrics v0.0.0-20210811180524-8494aeb34447
@@ -19,10 +21,12 @@ require (
 	github.com/streamingfast/firehose v0.1.1-0.20220114160935-8c52fe577b57
 	github.com/streamingfast/logging v0.0.0-20211221170249-09a6ecb200a0
 	github.com/streamingfast/merger v0.0.3-0.20220113161439-b31552a6aa77
+	github.com/streamingfast/node-manager v0.0.2-0.20220111134042-8a0db96986a1
 	github.com/streamingfast/pbgo v0.0.6-0.20220104194237-6534a2f6320b
 	github.com/streamingfast/relayer v0.0.2-0.20211210154316-8a6048581873
 	github.com/streamingfast/shutter v1.5.0
 	go.uber.org/zap v1.19.1
+	google.golang.org/grpc v1.43.0
 	google.golang.org/protobuf v1.27.1
 )
 
@@ -51,7 +55,6 @@ require (
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
-	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/go-cmp v0.5.6 // indirect
 	github.com/google/renameio v0.1.0 // indirect
 	github.com/google/uuid v1.2.0 // indirect
@@ -76,15 +79,14 @@ require (
 	github.com/prometheus/procfs v0.6.0 // indirect
 	github.com/prometheus/prom2json v1.3.0 // indirect
 	github.com/sethvargo/go-retry v0.1.0 // indirect
+	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/spf13/afero v1.6.0 // indirect
 	github.com/spf13/cast v1.4.1 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/streamingfast/atm v0.0.0-20211217182254-d1ed00f538eb // indirect
-	github.com/streamingfast/dgrpc v0.0.0-20211210152421-f8cec68e0383 // indirect
 	github.com/streamingfast/dmesh v0.0.0-20210811181323-5a37ad73216b // indirect
 	github.com/streamingfast/dtracing v0.0.0-20210811175635-d55665d3622a // indirect
-	github.com/streamingfast/node-manager v0.0.2-0.20220111134042-8a0db96986a1 // indirect
 	github.com/streamingfast/opaque v0.0.0-20210811180740-0c01d37ea308 // indirect
 	github.com/subosito/gotenv v1.2.0 // indirect
 	github.com/teris-io/shortid v0.0.0-20171029131806-771a37caa5cf // indirect
@@ -108,8 +110,10 @@ require (
 	google.golang.org/api v0.63.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/genproto v0.0.0-20211208223120-3a66f561d7aa // indirect
-	google.golang.org/grpc v1.43.0 // indirect
 	gopkg.in/ini.v1 v1.66.2 // indirect
 	gopkg.in/olivere/elastic.v3 v3.0.75 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+// The chain protobuf definitions used by the codec are not published yet, see README
+replace github.com/figment-networks/graph-instrumentation-example/chain => ../chain